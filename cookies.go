@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// In cookie mode (?mode=cookie on the login endpoints) the tokens are set as
+// HttpOnly cookies instead of being returned. Requests authenticated by the
+// cookie must echo the CSRF token in the X-CSRF-Token header when they change
+// state (double-submit).
+//
+// A frontend on another site cannot read the csrf_token cookie of the API
+// domain, so the token is also returned as csrfToken by the login and refresh
+// responses. The frontend keeps the latest one in memory; after a page load it
+// calls POST /api/token/refresh, which works with the refresh cookie alone,
+// to get a new one. Refresh needs no CSRF token: a forged request can only
+// rotate the victim's own cookies and cannot read the response.
+const (
+	accessCookieName  = "access_token"
+	refreshCookieName = "refresh_token"
+	csrfCookieName    = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+type CookieConfig struct {
+	Secure   bool
+	SameSite http.SameSite
+	Domain   string
+}
+
+var cookieConfig = CookieConfig{Secure: true, SameSite: http.SameSiteLaxMode}
+
+// newCookieConfigFromEnv reads COOKIE_SAMESITE (lax, strict or none),
+// COOKIE_SECURE (false for local http) and COOKIE_DOMAIN. A frontend on
+// another site than the API needs SameSite=None, which implies Secure.
+func newCookieConfigFromEnv() CookieConfig {
+	cfg := CookieConfig{
+		Secure:   os.Getenv("COOKIE_SECURE") != "false",
+		SameSite: http.SameSiteLaxMode,
+		Domain:   os.Getenv("COOKIE_DOMAIN"),
+	}
+	switch strings.ToLower(os.Getenv("COOKIE_SAMESITE")) {
+	case "strict":
+		cfg.SameSite = http.SameSiteStrictMode
+	case "none":
+		cfg.SameSite = http.SameSiteNoneMode
+		cfg.Secure = true
+	}
+	return cfg
+}
+
+func setCookie(c *gin.Context, name string, value string, path string, ttl time.Duration, httpOnly bool) {
+	maxAge := int(ttl.Seconds())
+	if ttl < 0 {
+		maxAge = -1
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   cookieConfig.Domain,
+		MaxAge:   maxAge,
+		Secure:   cookieConfig.Secure,
+		HttpOnly: httpOnly,
+		SameSite: cookieConfig.SameSite,
+	})
+}
+
+func wantsCookieSession(c *gin.Context) bool {
+	return c.Query("mode") == "cookie"
+}
+
+// setSessionCookies stores the tokens in cookies and returns the new CSRF
+// token, which the client reads from its cookie or from the response
+func setSessionCookies(c *gin.Context, tokens *AuthTokens) (string, error) {
+	csrf, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	setCookie(c, accessCookieName, tokens.Token, "/", accessTokenTTL, true)
+	setCookie(c, refreshCookieName, tokens.RefreshToken, "/api/token", refreshTokenTTL, true)
+	setCookie(c, csrfCookieName, csrf, "/", refreshTokenTTL, false)
+	return csrf, nil
+}
+
+func clearSessionCookies(c *gin.Context) {
+	setCookie(c, accessCookieName, "", "/", -1, true)
+	setCookie(c, refreshCookieName, "", "/api/token", -1, true)
+	setCookie(c, csrfCookieName, "", "/", -1, false)
+}
+
+// requestToken reads the access token from the Authorization header, with or
+// without the Bearer prefix, then from the session cookie
+func requestToken(c *gin.Context) (token string, fromCookie bool) {
+	if h := strings.TrimSpace(c.GetHeader("Authorization")); h != "" {
+		if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+			return strings.TrimSpace(h[7:]), false
+		}
+		return h, false
+	}
+	if t, err := c.Cookie(accessCookieName); err == nil && t != "" {
+		return t, true
+	}
+	return "", false
+}
+
+// validCSRF checks the double-submit token of state-changing requests
+func validCSRF(c *gin.Context) bool {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	cookie, err := c.Cookie(csrfCookieName)
+	header := c.GetHeader(csrfHeaderName)
+	if err != nil || cookie == "" || header == "" {
+		return false
+	}
+	return hmac.Equal([]byte(cookie), []byte(header))
+}
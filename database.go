@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var db *sql.DB
@@ -114,14 +116,228 @@ created_at TIMESTAMP DEFAULT now(),
 state INTEGER,
 viewed BOOLEAN DEFAULT false
 );
+-- Carts used to store {sku: quantity}; convert them to line items, picking
+-- the first color and size so they pass validation
+UPDATE carts c SET content = coalesce((
+SELECT jsonb_agg(jsonb_build_object('sku', e.key, 'color', coalesce(p.colors[1], ''), 'size', coalesce(p.sizes[1], ''), 'quantity', (e.value)::int))
+FROM jsonb_each_text(c.content) e
+LEFT JOIN products p ON p.sku = e.key
+), '[]'::jsonb)
+WHERE jsonb_typeof(c.content) = 'object';
+CREATE TABLE IF NOT EXISTS cart_state_history (
+id SERIAL PRIMARY KEY,
+cart_id INTEGER REFERENCES carts(id) ON DELETE CASCADE,
+from_state INTEGER NOT NULL,
+to_state INTEGER NOT NULL,
+actor_id INTEGER REFERENCES users(id),
+note TEXT NOT NULL DEFAULT '',
+created_at TIMESTAMP DEFAULT now()
+);
 CREATE TABLE IF NOT EXISTS product_category_links (
 product_sku TEXT REFERENCES products(SKU) ON DELETE CASCADE,
 category_id INTEGER REFERENCES product_categories(id) ON DELETE CASCADE,
 PRIMARY KEY (product_sku, category_id)
 );
+CREATE TABLE IF NOT EXISTS orders (
+id SERIAL PRIMARY KEY,
+user_id INTEGER REFERENCES users(id),
+cart_id INTEGER REFERENCES carts(id),
+total INTEGER NOT NULL,
+currency TEXT NOT NULL DEFAULT 'XOF',
+created_at TIMESTAMP DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS order_lines (
+id SERIAL PRIMARY KEY,
+order_id INTEGER REFERENCES orders(id) ON DELETE CASCADE,
+product_sku TEXT REFERENCES products(SKU),
+name TEXT,
+color TEXT,
+size TEXT,
+unit_price INTEGER NOT NULL,
+quantity INTEGER NOT NULL,
+line_total INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS payments (
+id SERIAL PRIMARY KEY,
+order_id INTEGER REFERENCES orders(id),
+provider TEXT NOT NULL,
+reference TEXT NOT NULL UNIQUE,
+amount INTEGER NOT NULL,
+status TEXT NOT NULL DEFAULT 'pending',
+created_at TIMESTAMP DEFAULT now(),
+updated_at TIMESTAMP DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS payments_one_active ON payments (order_id) WHERE status IN ('pending', 'succeeded');
+CREATE TABLE IF NOT EXISTS cash_collections (
+id SERIAL PRIMARY KEY,
+order_id INTEGER NOT NULL UNIQUE REFERENCES orders(id),
+courier_id INTEGER NOT NULL REFERENCES users(id),
+amount INTEGER NOT NULL,
+collected_at TIMESTAMP DEFAULT now()
+);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_method TEXT NOT NULL DEFAULT 'mobile_money';
+CREATE TABLE IF NOT EXISTS shipping_zones (
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL,
+localities TEXT[] NOT NULL DEFAULT '{}',
+international BOOLEAN NOT NULL DEFAULT false,
+base_fee INTEGER NOT NULL DEFAULT 0,
+per_item_fee INTEGER NOT NULL DEFAULT 0,
+per_kg_fee INTEGER NOT NULL DEFAULT 0,
+free_threshold INTEGER
+);
+INSERT INTO shipping_zones (name, localities, international, base_fee, per_item_fee, per_kg_fee, free_threshold)
+SELECT * FROM (VALUES
+('Dakar Plateau', '{"plateau","dakar plateau","médina","medina","fann","point e"}'::text[], false, 1000, 0, 0, 50000),
+('Pikine', '{"pikine","guédiawaye","guediawaye","thiaroye","keur massar"}'::text[], false, 1500, 0, 0, 75000),
+('Thiès', '{"thiès","thies"}'::text[], false, 2500, 0, 500, NULL::int),
+('International', '{}'::text[], true, 15000, 0, 5000, NULL::int)
+) AS z
+WHERE NOT EXISTS (SELECT 1 FROM shipping_zones);
+ALTER TABLE products ADD COLUMN IF NOT EXISTS weight_grams INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_fee INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_zone TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS addresses (
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+label TEXT NOT NULL DEFAULT '',
+recipient TEXT NOT NULL DEFAULT '',
+telephone TEXT NOT NULL,
+quartier TEXT NOT NULL,
+city TEXT NOT NULL,
+country TEXT NOT NULL DEFAULT 'SN',
+landmark TEXT NOT NULL DEFAULT '',
+is_default BOOLEAN NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX IF NOT EXISTS addresses_one_default ON addresses (user_id) WHERE is_default;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS shipping_address JSONB;
+CREATE TABLE IF NOT EXISTS user_roles (
+user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+role TEXT NOT NULL,
+granted_at TIMESTAMP DEFAULT now(),
+PRIMARY KEY (user_id, role)
+);
+CREATE TABLE IF NOT EXISTS sessions (
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+refresh_hash TEXT NOT NULL UNIQUE,
+previous_hash TEXT,
+user_agent TEXT NOT NULL DEFAULT '',
+ip TEXT NOT NULL DEFAULT '',
+created_at TIMESTAMP DEFAULT now(),
+last_used_at TIMESTAMP DEFAULT now(),
+expires_at TIMESTAMP NOT NULL,
+revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT true;
+ALTER TABLE users ALTER COLUMN email_verified SET DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+CREATE TABLE IF NOT EXISTS email_verifications (
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+email TEXT NOT NULL,
+token_hash TEXT NOT NULL UNIQUE,
+created_at TIMESTAMP DEFAULT now(),
+expires_at TIMESTAMP NOT NULL,
+used_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS phone_otps (
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+phone TEXT NOT NULL,
+purpose TEXT NOT NULL DEFAULT 'login', -- login or verify
+code_hash TEXT NOT NULL,
+attempts INTEGER NOT NULL DEFAULT 0,
+created_at TIMESTAMP DEFAULT now(),
+expires_at TIMESTAMP NOT NULL,
+used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS phone_otps_phone ON phone_otps (phone);
+-- Only numbers confirmed by a code log in, and each belongs to one account
+ALTER TABLE users ADD COLUMN IF NOT EXISTS telephone_verified BOOLEAN NOT NULL DEFAULT false;
+CREATE UNIQUE INDEX IF NOT EXISTS users_verified_telephone ON users ((right(regexp_replace(telephone, '\D', '', 'g'), 9))) WHERE telephone_verified;
+CREATE TABLE IF NOT EXISTS login_limits (
+key TEXT PRIMARY KEY,
+failures INTEGER NOT NULL DEFAULT 0,
+last_failure TIMESTAMPTZ NOT NULL,
+previous_failure TIMESTAMPTZ,
+locked_until TIMESTAMPTZ
+);
+CREATE TABLE IF NOT EXISTS limit_events (
+id SERIAL PRIMARY KEY,
+key TEXT NOT NULL,
+event TEXT NOT NULL,
+ip TEXT NOT NULL DEFAULT '',
+locked_until TIMESTAMPTZ,
+created_at TIMESTAMP DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+id BIGSERIAL PRIMARY KEY,
+created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+action TEXT NOT NULL,
+actor_id INTEGER REFERENCES users(id),
+target_type TEXT NOT NULL DEFAULT '',
+target_id TEXT NOT NULL DEFAULT '',
+ip TEXT NOT NULL DEFAULT '',
+user_agent TEXT NOT NULL DEFAULT '',
+details JSONB NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at);
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+CREATE TABLE IF NOT EXISTS api_keys (
+id SERIAL PRIMARY KEY,
+name TEXT NOT NULL,
+prefix TEXT NOT NULL,
+key_hash TEXT NOT NULL UNIQUE,
+scopes TEXT[] NOT NULL DEFAULT '{}',
+created_by INTEGER REFERENCES users(id),
+created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+expires_at TIMESTAMPTZ,
+last_used_at TIMESTAMPTZ,
+revoked_at TIMESTAMPTZ
+);
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS actor_api_key_id INTEGER REFERENCES api_keys(id);
+CREATE TABLE IF NOT EXISTS jwt_keys (
+kid TEXT PRIMARY KEY,
+alg TEXT NOT NULL,
+private_key TEXT NOT NULL, -- encrypted with JWT_KEY_ENCRYPTION_KEY
+created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+retired_at TIMESTAMPTZ
+);
+-- New keys are published before they start signing
+ALTER TABLE jwt_keys ADD COLUMN IF NOT EXISTS activates_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE TABLE IF NOT EXISTS user_totp (
+user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+secret TEXT NOT NULL,
+enabled BOOLEAN NOT NULL DEFAULT false,
+last_step BIGINT NOT NULL DEFAULT 0,
+created_at TIMESTAMP DEFAULT now()
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+code_hash TEXT NOT NULL,
+used_at TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS password_resets (
+id SERIAL PRIMARY KEY,
+user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+token_hash TEXT NOT NULL UNIQUE,
+created_at TIMESTAMP DEFAULT now(),
+expires_at TIMESTAMP NOT NULL,
+used_at TIMESTAMP
+);
 ` 
 // images JSONB example: {"red": ["1.jpg", "2.jpg"], "green": []}
-// content JSONB example: {"12743XF": 100, "DF234H": 0}
+// content JSONB example: [{"sku": "12743XF", "color": "red", "size": "M", "quantity": 2}]
 
 _, err := db.Exec(createTableQuery)
 if err != nil {
@@ -131,8 +347,8 @@ log.Fatal("Failed to create users table:", err)
 
 func getUserById(id int) (*User, error) {
 var user User
-row := db.QueryRow("SELECT id, prenom, nom, telephone, email, avatar_url FROM users WHERE id = $1", id)
-if err := row.Scan(&user.ID, &user.Prenom, &user.Nom, &user.Telephone, &user.Email, &user.AvatarURL); err != nil {
+row := db.QueryRow("SELECT id, coalesce(prenom, ''), coalesce(nom, ''), coalesce(telephone, ''), email, coalesce(avatar_url, ''), email_verified, telephone_verified FROM users WHERE id = $1", id)
+if err := row.Scan(&user.ID, &user.Prenom, &user.Nom, &user.Telephone, &user.Email, &user.AvatarURL, &user.EmailVerified, &user.TelephoneVerified); err != nil {
 	return nil, err
 }
 
@@ -273,7 +489,7 @@ func getBlogPostData(id string) (*BlogPost, error) {
 
 	var contentJSON []byte
 	err := db.QueryRow( `
-		select ar.id, ar.title, ar.image, ar."date", ar.summary, ar."content", ac.id, ac."name", au.id, au."name", au.title, au.summary, u.id, u.avatar_url
+		select ar.id, ar.title, ar.image, ar."date", ar.summary, ar."content", ac.id, ac."name", au.id, au."name", au.title, au.summary, u.id, coalesce(u.avatar_url, '')
 		from articles ar
 		join article_categories ac on ar.category_id = ac.id
 		join authors au on ar.author_id = au.id
@@ -283,7 +499,7 @@ func getBlogPostData(id string) (*BlogPost, error) {
 	b.Article.Date = formatFrenchDate(b.Article.Date)
 
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("Article with id %d not found", id)
+		return nil, fmt.Errorf("Article with id %s not found", id)
 	}
 
 	if err != nil {
@@ -315,7 +531,7 @@ func getBlogPostData(id string) (*BlogPost, error) {
 	}
 
 	cRows, err := db.Query(`
-		select c.id, c."date", c."comment", u.id, u.prenom, u.nom, u.avatar_url 
+		select c.id, c."date", c."comment", u.id, coalesce(u.prenom, ''), coalesce(u.nom, ''), coalesce(u.avatar_url, '') 
 		from "comments" c
 		join users u on c.user_id = u.id
 		where c.article_id = $1
@@ -560,3 +776,2644 @@ func searchRequest(category int, tags []int) string {
 
 	return req
 }
+
+func scanProduct(scanner interface{ Scan(...interface{}) error }, extra ...interface{}) (Product, error) {
+	var p Product
+	var imagesJSON []byte
+	var categories pq.Int64Array
+
+	dest := []interface{}{
+		&p.SKU, &p.CollectionID, &p.Name, &p.Note, &p.Price, &p.Description,
+		pq.Array(&p.Colors), &imagesJSON, pq.Array(&p.Sizes), &p.Quantity, &categories,
+	}
+	if err := scanner.Scan(append(dest, extra...)...); err != nil {
+		return p, fmt.Errorf("scan failed: %w", err)
+	}
+
+	if len(imagesJSON) > 0 {
+		if err := json.Unmarshal(imagesJSON, &p.Images); err != nil {
+			return p, fmt.Errorf("unmarshal images failed: %v", err)
+		}
+	}
+	for _, id := range categories {
+		p.Categories = append(p.Categories, int(id))
+	}
+
+	return p, nil
+}
+
+func getProducts(f ProductFilter, offset int, siz int) ([]Product, int, error) {
+	rows, err := db.Query(`
+		SELECT p.sku, p.collection_id, p.name, p.note, p.price, p.description, p.colors, p.images, p.sizes, p.quantity,
+		COALESCE(array_agg(pcl.category_id) FILTER (WHERE pcl.category_id IS NOT NULL), '{}'),
+		COUNT(*) OVER()
+		FROM products p
+		left join product_category_links pcl on pcl.product_sku = p.sku
+		where ($3 = 0 or p.collection_id = $3)
+		and ($4 = 0 or exists (select 1 from product_category_links x where x.product_sku = p.sku and x.category_id = $4))
+		and ($5 = '' or $5 = any(p.colors))
+		and ($6 = '' or $6 = any(p.sizes))
+		and ($7 = 0 or p.price >= $7)
+		and ($8 = 0 or p.price <= $8)
+		group by p.sku
+		order by p.name
+		OFFSET $1 ROWS FETCH NEXT $2 ROWS ONLY
+		`, offset, siz, f.Collection, f.Category, f.Color, f.Size, f.MinPrice, f.MaxPrice)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var products []Product
+	var rowCount int
+	for rows.Next() {
+		p, err := scanProduct(rows, &rowCount)
+		if err != nil {
+			return nil, rowCount, err
+		}
+		products = append(products, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, rowCount, fmt.Errorf("rows error: %v", err)
+	}
+
+	return products, rowCount, nil
+}
+
+func getProductDetailData(sku string) (*ProductDetail, error) {
+	var d ProductDetail
+
+	row := db.QueryRow(`
+		SELECT p.sku, p.collection_id, p.name, p.note, p.price, p.description, p.colors, p.images, p.sizes, p.quantity,
+		COALESCE(array_agg(pcl.category_id) FILTER (WHERE pcl.category_id IS NOT NULL), '{}')
+		FROM products p
+		left join product_category_links pcl on pcl.product_sku = p.sku
+		where p.sku = $1
+		group by p.sku
+		`, sku)
+	p, err := scanProduct(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("Product with sku %s not found", sku)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.Product = p
+
+	if p.CollectionID != nil {
+		var col Collection
+		err := db.QueryRow("select id, name, description from collections where id = $1", *p.CollectionID).
+			Scan(&col.ID, &col.Name, &col.Description)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("query failed: %v", err)
+		}
+		if err == nil {
+			d.Collection = &col
+		}
+	}
+
+	cRows, err := db.Query(`
+		select pc.id, pc.name
+		from product_category_links pcl
+		join product_categories pc on pcl.category_id = pc.id
+		where pcl.product_sku = $1
+		`, sku)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer cRows.Close()
+
+	for cRows.Next() {
+		var pc ProductCategory
+		if err := cRows.Scan(&pc.ID, &pc.Name); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		d.Categories = append(d.Categories, pc)
+	}
+
+	sRows, err := db.Query(`
+		WITH target_product AS (
+		SELECT sku, collection_id, name, description
+		FROM products
+		WHERE sku = $1
+		),
+		category_overlap AS (
+		SELECT pcl.product_sku,
+		COUNT(*) AS shared_categories
+		FROM product_category_links pcl
+		JOIN product_category_links target_pcl
+		ON pcl.category_id = target_pcl.category_id
+		WHERE target_pcl.product_sku = $1
+		AND pcl.product_sku != $1
+		GROUP BY pcl.product_sku
+		),
+		text_similarity AS (
+		SELECT p.sku,
+		ts_rank_cd(
+		to_tsvector('french', coalesce(p.name, '') || ' ' || coalesce(p.description, '')),
+		plainto_tsquery('french', coalesce(t.name, ''))
+		) AS text_rank
+		FROM products p
+		CROSS JOIN target_product t
+		WHERE p.sku != $1
+		)
+		SELECT p.sku, p.collection_id, p.name, p.note, p.price, p.description, p.colors, p.images, p.sizes, p.quantity,
+		COALESCE((select array_agg(x.category_id) from product_category_links x where x.product_sku = p.sku), '{}'),
+		(COALESCE(category_overlap.shared_categories, 0) * 2
+		+ CASE WHEN p.collection_id = t.collection_id THEN 1 ELSE 0 END
+		+ COALESCE(text_similarity.text_rank, 0)) AS similarity_score
+		FROM products p
+		CROSS JOIN target_product t
+		LEFT JOIN category_overlap ON p.sku = category_overlap.product_sku
+		LEFT JOIN text_similarity ON p.sku = text_similarity.sku
+		WHERE p.sku != $1
+		ORDER BY similarity_score DESC, p.name
+		LIMIT 4;
+		`, sku)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer sRows.Close()
+
+	var simScore float64
+	for sRows.Next() {
+		p, err := scanProduct(sRows, &simScore)
+		if err != nil {
+			return nil, err
+		}
+		d.Sims = append(d.Sims, p)
+	}
+
+	if err := sRows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return &d, nil
+}
+
+// inputError reports a request that is well formed but not acceptable,
+// so handlers can answer 400 instead of 500.
+type inputError struct {
+	msg string
+}
+
+func (e *inputError) Error() string {
+	return e.msg
+}
+
+func scanCart(scanner interface{ Scan(...interface{}) error }) (*Cart, error) {
+	var cart Cart
+	var contentJSON []byte
+	if err := scanner.Scan(&cart.ID, &cart.UserID, &contentJSON, &cart.CreatedAt, &cart.State, &cart.Viewed); err != nil {
+		return nil, err
+	}
+	if len(contentJSON) > 0 {
+		if err := json.Unmarshal(contentJSON, &cart.Content); err != nil {
+			return nil, fmt.Errorf("unmarshal cart content failed: %v", err)
+		}
+	}
+	return &cart, nil
+}
+
+// getActiveCart returns the user's open cart, creating an empty one if needed.
+func getActiveCart(userID int) (*Cart, error) {
+	cart, err := scanCart(db.QueryRow(`
+		select id, user_id, content, created_at, state, viewed
+		from carts
+		where user_id = $1 and state = $2
+		order by id desc
+		limit 1
+		`, userID, CartStateOpen))
+	if err == nil {
+		return cart, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+
+	cart, err = scanCart(db.QueryRow(`
+		insert into carts (user_id, content, state)
+		values ($1, '[]', $2)
+		returning id, user_id, content, created_at, state, viewed
+		`, userID, CartStateOpen))
+	if err != nil {
+		return nil, fmt.Errorf("insert failed: %v", err)
+	}
+	return cart, nil
+}
+
+// getGuestCart returns the open guest cart with the given id.
+func getGuestCart(id int) (*Cart, error) {
+	cart, err := scanCart(db.QueryRow(`
+		select id, user_id, content, created_at, state, viewed
+		from carts
+		where id = $1 and user_id is null and state = $2
+		`, id, CartStateOpen))
+	if err != nil {
+		return nil, err
+	}
+	return cart, nil
+}
+
+func createGuestCart() (*Cart, error) {
+	cart, err := scanCart(db.QueryRow(`
+		insert into carts (content, state)
+		values ('[]', $1)
+		returning id, user_id, content, created_at, state, viewed
+		`, CartStateOpen))
+	if err != nil {
+		return nil, fmt.Errorf("insert failed: %v", err)
+	}
+	return cart, nil
+}
+
+// mergeGuestCart moves the lines of a guest cart into the user's active cart
+// and deletes the guest cart. When both carts hold the same line the larger
+// quantity wins, and lines are then capped to what is still in stock.
+func mergeGuestCart(guestCartID int, userID int) error {
+	guest, err := getGuestCart(guestCartID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+
+	cart, err := getActiveCart(userID)
+	if err != nil {
+		return err
+	}
+
+	content := append([]CartItem(nil), cart.Content...)
+	for _, it := range guest.Content {
+		i := findCartItem(&Cart{Content: content}, it)
+		if i < 0 {
+			content = append(content, it)
+		} else if it.Quantity > content[i].Quantity {
+			content[i].Quantity = it.Quantity
+		}
+	}
+
+	cart.Content, err = clampCartContent(content)
+	if err != nil {
+		return err
+	}
+	if err := saveCartContent(cart); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("delete from carts where id = $1", guest.ID); err != nil {
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	return nil
+}
+
+// clampCartContent drops lines that no longer match a product and reduces
+// quantities so that every sku fits in the available stock.
+func clampCartContent(items []CartItem) ([]CartItem, error) {
+	var skus []string
+	for _, it := range items {
+		skus = append(skus, it.SKU)
+	}
+	products, err := getProductsBySKU(skus)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[string]int)
+	for sku, p := range products {
+		remaining[sku] = p.Quantity
+	}
+
+	clamped := []CartItem{}
+	for _, it := range items {
+		p, ok := products[it.SKU]
+		if !ok {
+			continue
+		}
+		if len(p.Colors) > 0 && !containsString(p.Colors, it.Color) {
+			continue
+		}
+		if len(p.Sizes) > 0 && !containsString(p.Sizes, it.Size) {
+			continue
+		}
+		if it.Quantity > remaining[it.SKU] {
+			it.Quantity = remaining[it.SKU]
+		}
+		if it.Quantity <= 0 {
+			continue
+		}
+		remaining[it.SKU] -= it.Quantity
+		clamped = append(clamped, it)
+	}
+
+	return clamped, nil
+}
+
+func saveCartContent(cart *Cart) error {
+	if cart.Content == nil {
+		cart.Content = []CartItem{}
+	}
+	contentJSON, err := json.Marshal(cart.Content)
+	if err != nil {
+		return fmt.Errorf("marshal cart content failed: %v", err)
+	}
+	if _, err := db.Exec("update carts set content = $1 where id = $2", contentJSON, cart.ID); err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+func getProductsBySKU(skus []string) (map[string]Product, error) {
+	rows, err := db.Query(`
+		SELECT p.sku, p.collection_id, p.name, p.note, p.price, p.description, p.colors, p.images, p.sizes, p.quantity,
+		COALESCE(array_agg(pcl.category_id) FILTER (WHERE pcl.category_id IS NOT NULL), '{}')
+		FROM products p
+		left join product_category_links pcl on pcl.product_sku = p.sku
+		where p.sku = any($1)
+		group by p.sku
+		`, pq.Array(skus))
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	products := make(map[string]Product)
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, err
+		}
+		products[p.SKU] = p
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return products, nil
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCartContent checks every line against the product's colors, sizes
+// and stock. Stock is compared to the sum of all lines sharing a sku.
+func validateCartContent(items []CartItem) error {
+	var skus []string
+	wanted := make(map[string]int)
+	for _, it := range items {
+		if _, ok := wanted[it.SKU]; !ok {
+			skus = append(skus, it.SKU)
+		}
+		wanted[it.SKU] += it.Quantity
+	}
+
+	products, err := getProductsBySKU(skus)
+	if err != nil {
+		return err
+	}
+
+	for _, it := range items {
+		p, ok := products[it.SKU]
+		if !ok {
+			return &inputError{fmt.Sprintf("Product %s does not exist", it.SKU)}
+		}
+		if it.Quantity <= 0 {
+			return &inputError{fmt.Sprintf("Invalid quantity for product %s", it.SKU)}
+		}
+		if len(p.Colors) > 0 && !containsString(p.Colors, it.Color) {
+			return &inputError{fmt.Sprintf("Color %q is not available for product %s", it.Color, it.SKU)}
+		}
+		if len(p.Sizes) > 0 && !containsString(p.Sizes, it.Size) {
+			return &inputError{fmt.Sprintf("Size %q is not available for product %s", it.Size, it.SKU)}
+		}
+		if wanted[it.SKU] > p.Quantity {
+			return &inputError{fmt.Sprintf("Only %d left in stock for product %s", p.Quantity, it.SKU)}
+		}
+	}
+
+	return nil
+}
+
+func findCartItem(cart *Cart, item CartItem) int {
+	for i, it := range cart.Content {
+		if it.SKU == item.SKU && it.Color == item.Color && it.Size == item.Size {
+			return i
+		}
+	}
+	return -1
+}
+
+// setCartItem adds item to the cart, or replaces the quantity of the matching
+// line when add is false. A resulting quantity of zero removes the line.
+func setCartItem(cart *Cart, item CartItem, add bool) error {
+	content := append([]CartItem(nil), cart.Content...)
+	i := findCartItem(cart, item)
+	switch {
+	case i < 0 && item.Quantity > 0:
+		content = append(content, item)
+	case i >= 0 && add:
+		content[i].Quantity += item.Quantity
+	case i >= 0:
+		content[i].Quantity = item.Quantity
+	}
+	if i >= 0 && content[i].Quantity <= 0 {
+		content = append(content[:i], content[i+1:]...)
+	}
+
+	if err := validateCartContent(content); err != nil {
+		return err
+	}
+
+	cart.Content = content
+	return saveCartContent(cart)
+}
+
+func removeCartItem(cart *Cart, item CartItem) error {
+	i := findCartItem(cart, item)
+	if i < 0 {
+		return &inputError{fmt.Sprintf("Product %s is not in the cart", item.SKU)}
+	}
+	cart.Content = append(cart.Content[:i], cart.Content[i+1:]...)
+	return saveCartContent(cart)
+}
+
+func clearCart(cart *Cart) error {
+	cart.Content = []CartItem{}
+	return saveCartContent(cart)
+}
+
+// getCartView prices every line of the cart with the current product prices.
+func getCartView(cart *Cart) (*CartView, error) {
+	v := CartView{Cart: *cart, Lines: []CartLine{}, Currency: "XOF"}
+
+	var skus []string
+	for _, it := range cart.Content {
+		skus = append(skus, it.SKU)
+	}
+	products, err := getProductsBySKU(skus)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, it := range cart.Content {
+		p := products[it.SKU]
+		line := CartLine{CartItem: it, Name: p.Name, UnitPrice: p.Price, LineTotal: p.Price * it.Quantity}
+		v.Lines = append(v.Lines, line)
+		v.Total += line.LineTotal
+	}
+
+	return &v, nil
+}
+
+// checkoutCart turns the user's active cart into an order. Prices and names
+// are copied into the order lines, stock is decremented and the cart is
+// marked converted, all in one transaction.
+func checkoutCart(userID int, info CheckoutRequestInfo) (*Order, error) {
+	cart, err := getActiveCart(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(cart.Content) == 0 {
+		return nil, &inputError{"Cart is empty"}
+	}
+	if err := validateCartContent(cart.Content); err != nil {
+		return nil, err
+	}
+
+	address, err := checkoutAddress(userID, info)
+	if err != nil {
+		return nil, err
+	}
+	dest := info.ShippingDestination
+	if address != nil {
+		dest = address.Destination()
+	}
+	zone, err := resolveShippingZone(dest)
+	if err != nil {
+		return nil, err
+	}
+	var addressJSON []byte
+	if address != nil {
+		if addressJSON, err = json.Marshal(address); err != nil {
+			return nil, fmt.Errorf("marshal address failed: %v", err)
+		}
+	}
+	grams, err := getItemsWeight(cart.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := transitionCart(tx, cart.ID, CartStateCheckedOut, &userID, ""); err != nil {
+		return nil, err
+	}
+
+	o := Order{UserID: userID, CartID: cart.ID, ShippingZone: zone.Name, ShippingAddress: address}
+	var items int
+	for _, it := range cart.Content {
+		l := OrderLine{SKU: it.SKU, Color: it.Color, Size: it.Size, Quantity: it.Quantity}
+		err := tx.QueryRow(`
+			update products set quantity = quantity - $1
+			where sku = $2 and quantity >= $1
+			returning name, price
+			`, it.Quantity, it.SKU).Scan(&l.Name, &l.UnitPrice)
+		if err == sql.ErrNoRows {
+			return nil, &inputError{fmt.Sprintf("Not enough stock for product %s", it.SKU)}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("update failed: %v", err)
+		}
+		l.LineTotal = l.UnitPrice * l.Quantity
+		o.Total += l.LineTotal
+		items += l.Quantity
+		o.Lines = append(o.Lines, l)
+	}
+	o.ShippingFee = zone.Fee(o.Total, items, grams)
+	o.Total += o.ShippingFee
+
+	err = tx.QueryRow(`
+		insert into orders (user_id, cart_id, total, payment_method, shipping_fee, shipping_zone, shipping_address)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		returning id, currency, created_at, payment_method
+		`, userID, cart.ID, o.Total, info.PaymentMethod, o.ShippingFee, o.ShippingZone, addressJSON).Scan(&o.ID, &o.Currency, &o.CreatedAt, &o.PaymentMethod)
+	if err != nil {
+		return nil, fmt.Errorf("insert failed: %v", err)
+	}
+
+	// Cash is collected by the courier, the payment stays pending until then
+	if o.PaymentMethod == PaymentMethodCashOnDelivery {
+		_, err := tx.Exec(`
+			insert into payments (order_id, provider, reference, amount)
+			values ($1, $2, $3, $4)
+			`, o.ID, PaymentMethodCashOnDelivery, fmt.Sprintf("cod_%d", o.ID), o.Total)
+		if err != nil {
+			return nil, fmt.Errorf("insert failed: %v", err)
+		}
+	}
+
+	for _, l := range o.Lines {
+		_, err := tx.Exec(`
+			insert into order_lines (order_id, product_sku, name, color, size, unit_price, quantity, line_total)
+			values ($1, $2, $3, $4, $5, $6, $7, $8)
+			`, o.ID, l.SKU, l.Name, l.Color, l.Size, l.UnitPrice, l.Quantity, l.LineTotal)
+		if err != nil {
+			return nil, fmt.Errorf("insert failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("commit failed: %v", err)
+	}
+
+	o.CreatedAt = formatFrenchDate(o.CreatedAt)
+	o.History, err = getCartHistory(cart.ID)
+	if err != nil {
+		return nil, err
+	}
+	o.State = o.History[len(o.History)-1].To
+	return &o, nil
+}
+
+func getOrderLines(orderID int) ([]OrderLine, error) {
+	rows, err := db.Query(`
+		select product_sku, name, color, size, unit_price, quantity, line_total
+		from order_lines
+		where order_id = $1
+		order by id
+		`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var lines []OrderLine
+	for rows.Next() {
+		var l OrderLine
+		if err := rows.Scan(&l.SKU, &l.Name, &l.Color, &l.Size, &l.UnitPrice, &l.Quantity, &l.LineTotal); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		lines = append(lines, l)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return lines, nil
+}
+
+const orderColumns = "o.id, o.user_id, o.cart_id, o.total, o.shipping_fee, o.shipping_zone, o.shipping_address, o.currency, o.payment_method, o.created_at"
+
+// scanOrder reads a row starting with orderColumns. Scan errors are returned
+// as is so callers can check for sql.ErrNoRows.
+func scanOrder(scanner interface{ Scan(...interface{}) error }, extra ...interface{}) (*Order, error) {
+	var o Order
+	var addressJSON []byte
+	dest := []interface{}{
+		&o.ID, &o.UserID, &o.CartID, &o.Total, &o.ShippingFee, &o.ShippingZone, &addressJSON,
+		&o.Currency, &o.PaymentMethod, &o.CreatedAt,
+	}
+	if err := scanner.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if len(addressJSON) > 0 {
+		if err := json.Unmarshal(addressJSON, &o.ShippingAddress); err != nil {
+			return nil, fmt.Errorf("unmarshal address failed: %v", err)
+		}
+	}
+	o.CreatedAt = formatFrenchDate(o.CreatedAt)
+	return &o, nil
+}
+
+func getUserOrders(userID int, offset int, siz int) ([]Order, int, error) {
+	rows, err := db.Query(`
+		select `+orderColumns+`, COUNT(*) OVER()
+		from orders o
+		where o.user_id = $3
+		order by o.created_at desc, o.id desc
+		OFFSET $1 ROWS FETCH NEXT $2 ROWS ONLY
+		`, offset, siz, userID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var orders []Order
+	var rowCount int
+	for rows.Next() {
+		o, err := scanOrder(rows, &rowCount)
+		if err != nil {
+			return nil, rowCount, fmt.Errorf("scan failed: %v", err)
+		}
+		orders = append(orders, *o)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, rowCount, fmt.Errorf("rows error: %v", err)
+	}
+
+	for i := range orders {
+		if err := loadOrderDetails(&orders[i]); err != nil {
+			return nil, rowCount, err
+		}
+	}
+
+	return orders, rowCount, nil
+}
+
+// dbtx is implemented by both *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// transitionCart moves a cart to a new state if the lifecycle allows it and
+// records the change in cart_state_history.
+func transitionCart(q dbtx, cartID int, to CartState, actorID *int, note string) error {
+	var from CartState
+	var method string
+	err := q.QueryRow(`
+		select c.state, coalesce(o.payment_method, '')
+		from carts c
+		left join orders o on o.cart_id = c.id
+		where c.id = $1
+		for update of c
+		`, cartID).Scan(&from, &method)
+	if err == sql.ErrNoRows {
+		return &inputError{fmt.Sprintf("Cart %d not found", cartID)}
+	}
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+
+	if !from.CanTransitionTo(to, method) {
+		return &inputError{fmt.Sprintf("Cannot move from %s to %s", from, to)}
+	}
+
+	if _, err := q.Exec("update carts set state = $1 where id = $2", to, cartID); err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	// The stock taken at checkout goes back on the shelf
+	if to == CartStateCancelled || to == CartStateRefunded {
+		_, err := q.Exec(`
+			update products p set quantity = coalesce(p.quantity, 0) + l.quantity
+			from (
+			select ol.product_sku, sum(ol.quantity) as quantity
+			from order_lines ol
+			join orders o on o.id = ol.order_id
+			where o.cart_id = $1
+			group by ol.product_sku
+			) l
+			where p.sku = l.product_sku
+			`, cartID)
+		if err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+	}
+	_, err = q.Exec(`
+		insert into cart_state_history (cart_id, from_state, to_state, actor_id, note)
+		values ($1, $2, $3, $4, $5)
+		`, cartID, from, to, actorID, note)
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+
+	// The payment follows the order. A refund goes last because it moves
+	// money: if the provider refuses it the whole transition is rolled back.
+	switch to {
+	case CartStateCancelled:
+		_, err := q.Exec(`
+			update payments set status = $2, updated_at = now()
+			where order_id = (select id from orders where cart_id = $1) and status = $3
+			`, cartID, PaymentCancelled, PaymentPending)
+		if err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+	case CartStateRefunded:
+		if err := refundCartPayment(q, cartID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refundCartPayment gives back the succeeded payment of an order. Mobile
+// money is refunded through its provider; cash on delivery is handed back by
+// the shop and only recorded.
+func refundCartPayment(q dbtx, cartID int) error {
+	var p Payment
+	err := q.QueryRow(`
+		select p.id, p.provider, p.reference, p.amount
+		from payments p
+		join orders o on o.id = p.order_id
+		where o.cart_id = $1 and p.status = $2
+		for update of p
+		`, cartID, PaymentSucceeded).Scan(&p.ID, &p.Provider, &p.Reference, &p.Amount)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+
+	if provider, ok := paymentProviders[p.Provider]; ok {
+		if err := provider.Refund(p.Reference, p.Amount); err != nil {
+			return fmt.Errorf("refund failed: %v", err)
+		}
+	} else if p.Provider != PaymentMethodCashOnDelivery {
+		return fmt.Errorf("refund failed: unknown payment provider %s", p.Provider)
+	}
+
+	_, err = q.Exec("update payments set status = $1, updated_at = now() where id = $2", PaymentRefunded, p.ID)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+// transitionCartNow runs transitionCart in its own transaction
+func transitionCartNow(cartID int, to CartState, actorID *int, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := transitionCart(tx, cartID, to, actorID, note); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+func getCartHistory(cartID int) ([]StateChange, error) {
+	rows, err := db.Query(`
+		select from_state, to_state, actor_id, note, created_at
+		from cart_state_history
+		where cart_id = $1
+		order by created_at, id
+		`, cartID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var history []StateChange
+	for rows.Next() {
+		var h StateChange
+		if err := rows.Scan(&h.From, &h.To, &h.ActorID, &h.Note, &h.Date); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		h.Date = formatFrenchDate(h.Date)
+		history = append(history, h)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return history, nil
+}
+
+// loadOrderDetails fills the lines and history of an order. The order state
+// is the last state recorded in the history.
+func loadOrderDetails(o *Order) error {
+	var err error
+	o.Lines, err = getOrderLines(o.ID)
+	if err != nil {
+		return err
+	}
+	o.History, err = getCartHistory(o.CartID)
+	if err != nil {
+		return err
+	}
+	if len(o.History) > 0 {
+		o.State = o.History[len(o.History)-1].To
+	}
+	return nil
+}
+
+func getOrder(id int) (*Order, error) {
+	o, err := scanOrder(db.QueryRow(`
+		select `+orderColumns+`
+		from orders o
+		where o.id = $1
+		`, id))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadOrderDetails(o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+var errPaymentInProgress = errors.New("A payment is already in progress for this order")
+
+// createPayment records a pending payment. The payments_one_active index
+// refuses a second one while another is pending or succeeded.
+func createPayment(orderID int, provider string, reference string, amount int) error {
+	_, err := db.Exec(`
+		insert into payments (order_id, provider, reference, amount)
+		values ($1, $2, $3, $4)
+		`, orderID, provider, reference, amount)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return errPaymentInProgress
+	}
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	return nil
+}
+
+// getActivePayment returns the pending or succeeded payment of an order
+func getActivePayment(orderID int) (*Payment, error) {
+	var p Payment
+	err := db.QueryRow(`
+		select id, order_id, provider, reference, amount, status, created_at
+		from payments
+		where order_id = $1 and status in ('pending', 'succeeded')
+		`, orderID).Scan(&p.ID, &p.OrderID, &p.Provider, &p.Reference, &p.Amount, &p.Status, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func getPayment(provider string, reference string) (*Payment, error) {
+	var p Payment
+	err := db.QueryRow(`
+		select id, order_id, provider, reference, amount, status, created_at
+		from payments
+		where provider = $1 and reference = $2
+		`, provider, reference).Scan(&p.ID, &p.OrderID, &p.Provider, &p.Reference, &p.Amount, &p.Status, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// settlePayment records the provider's verdict on a payment. A successful
+// payment moves the order's cart to paid. Settling twice is a no-op.
+//
+// A payment that succeeds after its order was cancelled is still recorded
+// as succeeded, noted in the order history and refunded; if the refund fails
+// the payment stays succeeded on the cancelled order for the shop to refund.
+func settlePayment(p *Payment, result *PaymentResult) error {
+	if (p.Status != PaymentPending && p.Status != PaymentCancelled) || result.Status == PaymentPending {
+		return nil
+	}
+	if result.Status == PaymentSucceeded && result.Amount != p.Amount {
+		return &inputError{fmt.Sprintf("Paid amount %d does not match %d", result.Amount, p.Amount)}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		update payments set status = $1, updated_at = now()
+		where id = $2 and status in ($3, $4)
+		`, result.Status, p.ID, PaymentPending, PaymentCancelled)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	late := false
+	var cartID int
+	if result.Status == PaymentSucceeded {
+		var state CartState
+		var method string
+		err := tx.QueryRow(`
+			select c.id, c.state, o.payment_method
+			from orders o
+			join carts c on c.id = o.cart_id
+			where o.id = $1
+			for update of c
+			`, p.OrderID).Scan(&cartID, &state, &method)
+		if err != nil {
+			return fmt.Errorf("query failed: %v", err)
+		}
+
+		if state.CanTransitionTo(CartStatePaid, method) {
+			note := fmt.Sprintf("Paid with %s (%s)", p.Provider, p.Reference)
+			if err := transitionCart(tx, cartID, CartStatePaid, nil, note); err != nil {
+				return err
+			}
+		} else {
+			late = true
+			note := fmt.Sprintf("Paid with %s (%s) after the order was %s, refund needed", p.Provider, p.Reference, state)
+			if err := addCartNote(tx, cartID, state, note); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	if late {
+		refundLatePayment(p, cartID)
+	}
+	return nil
+}
+
+// addCartNote writes a note in the order history without changing its state
+func addCartNote(q dbtx, cartID int, state CartState, note string) error {
+	_, err := q.Exec(`
+		insert into cart_state_history (cart_id, from_state, to_state, note)
+		values ($1, $2, $2, $3)
+		`, cartID, state, note)
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	return nil
+}
+
+// refundLatePayment gives back a payment that arrived after its order was
+// cancelled. Failures are logged and leave the payment succeeded, which
+// flags it for a manual refund.
+func refundLatePayment(p *Payment, cartID int) {
+	provider, ok := paymentProviders[p.Provider]
+	if !ok {
+		log.Printf("Cannot refund late payment %s: unknown provider %s", p.Reference, p.Provider)
+		return
+	}
+	if err := provider.Refund(p.Reference, p.Amount); err != nil {
+		log.Printf("Failed to refund late payment %s: %v", p.Reference, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Refunded late payment %s but failed to record it: %v", p.Reference, err)
+		return
+	}
+	defer tx.Rollback()
+
+	var state CartState
+	_, err = tx.Exec("update payments set status = $1, updated_at = now() where id = $2", PaymentRefunded, p.ID)
+	if err == nil {
+		err = tx.QueryRow("select state from carts where id = $1", cartID).Scan(&state)
+	}
+	if err == nil {
+		err = addCartNote(tx, cartID, state, fmt.Sprintf("Late payment %s refunded", p.Reference))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Refunded late payment %s but failed to record it: %v", p.Reference, err)
+	}
+}
+
+// collectCashPayment records the cash a courier collected at the door. The
+// amount must match the order total; the order is then paid and delivered.
+func collectCashPayment(orderID int, courierID int, amount int) error {
+	order, err := getOrder(orderID)
+	if err == sql.ErrNoRows {
+		return &inputError{fmt.Sprintf("Order %d not found", orderID)}
+	}
+	if err != nil {
+		return err
+	}
+	if order.PaymentMethod != PaymentMethodCashOnDelivery {
+		return &inputError{"Order is not paid on delivery"}
+	}
+	if amount != order.Total {
+		return &inputError{fmt.Sprintf("Collected amount %d does not match order total %d", amount, order.Total)}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		insert into cash_collections (order_id, courier_id, amount)
+		values ($1, $2, $3)
+		`, orderID, courierID, amount)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return &inputError{"Cash was already collected for this order"}
+		}
+		return fmt.Errorf("insert failed: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		update payments set status = $1, updated_at = now()
+		where order_id = $2 and provider = $3
+		`, PaymentSucceeded, orderID, PaymentMethodCashOnDelivery)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+
+	note := fmt.Sprintf("Cash collected by courier %d", courierID)
+	if err := transitionCart(tx, order.CartID, CartStatePaid, &courierID, note); err != nil {
+		return err
+	}
+	if err := transitionCart(tx, order.CartID, CartStateDelivered, &courierID, ""); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// getCourierReconciliation lists what a courier collected on a given day
+// (YYYY-MM-DD)
+func getCourierReconciliation(courierID int, date string) (*CourierReconciliation, error) {
+	r := CourierReconciliation{CourierID: courierID, Date: date, Collections: []CashCollection{}}
+
+	rows, err := db.Query(`
+		select order_id, courier_id, amount, collected_at
+		from cash_collections
+		where courier_id = $1 and collected_at::date = $2::date
+		order by collected_at
+		`, courierID, date)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cc CashCollection
+		if err := rows.Scan(&cc.OrderID, &cc.CourierID, &cc.Amount, &cc.CollectedAt); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		r.Total += cc.Amount
+		r.Collections = append(r.Collections, cc)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return &r, nil
+}
+
+func scanShippingZone(scanner interface{ Scan(...interface{}) error }) (*ShippingZone, error) {
+	var z ShippingZone
+	err := scanner.Scan(&z.ID, &z.Name, pq.Array(&z.Localities), &z.International, &z.BaseFee, &z.PerItemFee, &z.PerKgFee, &z.FreeThreshold)
+	if err != nil {
+		return nil, err
+	}
+	return &z, nil
+}
+
+func getShippingZones() ([]ShippingZone, error) {
+	rows, err := db.Query(`
+		select id, name, localities, international, base_fee, per_item_fee, per_kg_fee, free_threshold
+		from shipping_zones
+		order by id
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var zones []ShippingZone
+	for rows.Next() {
+		z, err := scanShippingZone(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		zones = append(zones, *z)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return zones, nil
+}
+
+func isSenegal(country string) bool {
+	switch strings.ToLower(strings.TrimSpace(country)) {
+	case "", "sn", "sen", "senegal", "sénégal":
+		return true
+	}
+	return false
+}
+
+// resolveShippingZone finds the zone delivering to a destination. The
+// quartier is tried before the city; addresses abroad go to the
+// international zone.
+func resolveShippingZone(dest ShippingDestination) (*ShippingZone, error) {
+	zones, err := getShippingZones()
+	if err != nil {
+		return nil, err
+	}
+
+	if !isSenegal(dest.Country) {
+		for _, z := range zones {
+			if z.International {
+				return &z, nil
+			}
+		}
+		return nil, &inputError{"International delivery is not available"}
+	}
+
+	for _, place := range []string{dest.Quartier, dest.City} {
+		place = strings.ToLower(strings.TrimSpace(place))
+		if place == "" {
+			continue
+		}
+		for _, z := range zones {
+			if !z.International && containsString(z.Localities, place) {
+				return &z, nil
+			}
+		}
+	}
+
+	if dest.Quartier == "" && dest.City == "" {
+		return nil, &inputError{"A delivery address is required"}
+	}
+	return nil, &inputError{"Delivery is not available in this area"}
+}
+
+// getItemsWeight returns the total weight in grams of the given cart items
+func getItemsWeight(items []CartItem) (int, error) {
+	var skus []string
+	for _, it := range items {
+		skus = append(skus, it.SKU)
+	}
+
+	rows, err := db.Query("select sku, weight_grams from products where sku = any($1)", pq.Array(skus))
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	weights := make(map[string]int)
+	for rows.Next() {
+		var sku string
+		var w int
+		if err := rows.Scan(&sku, &w); err != nil {
+			return 0, fmt.Errorf("scan failed: %v", err)
+		}
+		weights[sku] = w
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows error: %v", err)
+	}
+
+	var grams int
+	for _, it := range items {
+		grams += weights[it.SKU] * it.Quantity
+	}
+	return grams, nil
+}
+
+func quoteShipping(cart *Cart, dest ShippingDestination) (*ShippingQuote, error) {
+	zone, err := resolveShippingZone(dest)
+	if err != nil {
+		return nil, err
+	}
+	view, err := getCartView(cart)
+	if err != nil {
+		return nil, err
+	}
+	grams, err := getItemsWeight(cart.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	var items int
+	for _, it := range cart.Content {
+		items += it.Quantity
+	}
+
+	q := ShippingQuote{Zone: *zone, Subtotal: view.Total, Currency: "XOF"}
+	q.Fee = zone.Fee(q.Subtotal, items, grams)
+	q.Total = q.Subtotal + q.Fee
+	return &q, nil
+}
+
+const addressColumns = "id, label, recipient, telephone, quartier, city, country, landmark, is_default"
+
+func scanAddress(scanner interface{ Scan(...interface{}) error }) (*Address, error) {
+	var a Address
+	err := scanner.Scan(&a.ID, &a.Label, &a.Recipient, &a.Telephone, &a.Quartier, &a.City, &a.Country, &a.Landmark, &a.IsDefault)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func getAddresses(userID int) ([]Address, error) {
+	rows, err := db.Query(`
+		select `+addressColumns+`
+		from addresses
+		where user_id = $1
+		order by is_default desc, id
+		`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	addresses := []Address{}
+	for rows.Next() {
+		a, err := scanAddress(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		addresses = append(addresses, *a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return addresses, nil
+}
+
+// getAddress returns sql.ErrNoRows when the address does not belong to the user
+func getAddress(userID int, id int) (*Address, error) {
+	return scanAddress(db.QueryRow(`
+		select `+addressColumns+`
+		from addresses
+		where user_id = $1 and id = $2
+		`, userID, id))
+}
+
+func getDefaultAddress(userID int) (*Address, error) {
+	return scanAddress(db.QueryRow(`
+		select `+addressColumns+`
+		from addresses
+		where user_id = $1 and is_default
+		`, userID))
+}
+
+// saveAddress inserts a (when a.ID is 0) or updates an address. The first
+// address of a user becomes the default one, and making an address the
+// default clears the flag on the others.
+func saveAddress(userID int, a *Address) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var others int
+	if err := tx.QueryRow("select count(*) from addresses where user_id = $1 and id != $2", userID, a.ID).Scan(&others); err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	if others == 0 {
+		a.IsDefault = true
+	}
+	if a.IsDefault {
+		if _, err := tx.Exec("update addresses set is_default = false where user_id = $1 and id != $2", userID, a.ID); err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+	}
+
+	if a.ID == 0 {
+		err = tx.QueryRow(`
+			insert into addresses (user_id, label, recipient, telephone, quartier, city, country, landmark, is_default)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			returning id
+			`, userID, a.Label, a.Recipient, a.Telephone, a.Quartier, a.City, a.Country, a.Landmark, a.IsDefault).Scan(&a.ID)
+		if err != nil {
+			return fmt.Errorf("insert failed: %v", err)
+		}
+	} else {
+		res, err := tx.Exec(`
+			update addresses
+			set label = $3, recipient = $4, telephone = $5, quartier = $6, city = $7, country = $8, landmark = $9, is_default = $10
+			where user_id = $1 and id = $2
+			`, userID, a.ID, a.Label, a.Recipient, a.Telephone, a.Quartier, a.City, a.Country, a.Landmark, a.IsDefault)
+		if err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return sql.ErrNoRows
+		}
+	}
+
+	// Unsetting the default one promotes the oldest other address, as when
+	// the default address is deleted
+	if !a.IsDefault {
+		_, err := tx.Exec(`
+			update addresses set is_default = true
+			where id = (select id from addresses where user_id = $1 and id != $2 order by id limit 1)
+			and not exists (select 1 from addresses where user_id = $1 and is_default)
+			`, userID, a.ID)
+		if err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// deleteAddress removes an address and, if it was the default one, promotes
+// the oldest remaining address
+func deleteAddress(userID int, id int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var wasDefault bool
+	err = tx.QueryRow("delete from addresses where user_id = $1 and id = $2 returning is_default", userID, id).Scan(&wasDefault)
+	if err != nil {
+		return err
+	}
+	if wasDefault {
+		_, err := tx.Exec(`
+			update addresses set is_default = true
+			where id = (select id from addresses where user_id = $1 order by id limit 1)
+			`, userID)
+		if err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// checkoutAddress picks the address an order is shipped to: the one given by
+// id, else the default address when no destination was typed in.
+func checkoutAddress(userID int, info CheckoutRequestInfo) (*Address, error) {
+	if info.AddressID != 0 {
+		a, err := getAddress(userID, info.AddressID)
+		if err == sql.ErrNoRows {
+			return nil, &inputError{"Address not found"}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("query failed: %v", err)
+		}
+		return a, nil
+	}
+
+	if info.City != "" || info.Quartier != "" || info.Country != "" {
+		return nil, nil
+	}
+
+	a, err := getDefaultAddress(userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	return a, nil
+}
+
+// getAdminOrders lists orders for the admin inbox. A negative state matches
+// every state; from and to are inclusive YYYY-MM-DD dates or empty.
+func getAdminOrders(f AdminOrderFilter, state CartState, offset int, siz int) ([]AdminOrder, int, error) {
+	rows, err := db.Query(`
+		select `+orderColumns+`, coalesce(c.viewed, false), coalesce(u.prenom, ''), coalesce(u.nom, ''), coalesce(u.email, ''), coalesce(u.telephone, ''),
+		COUNT(*) OVER()
+		from orders o
+		join carts c on c.id = o.cart_id
+		left join users u on u.id = o.user_id
+		where ($3 < 0 or c.state = $3)
+		and (nullif($4, '')::date is null or o.created_at >= nullif($4, '')::date)
+		and (nullif($5, '')::date is null or o.created_at < nullif($5, '')::date + 1)
+		and (not $6 or not coalesce(c.viewed, false))
+		order by o.created_at desc, o.id desc
+		OFFSET $1 ROWS FETCH NEXT $2 ROWS ONLY
+		`, offset, siz, state, f.From, f.To, f.Unviewed)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	var orders []AdminOrder
+	var rowCount int
+	for rows.Next() {
+		var a AdminOrder
+		o, err := scanOrder(rows, &a.Viewed, &a.Customer.Prenom, &a.Customer.Nom, &a.Customer.Email, &a.Customer.Telephone, &rowCount)
+		if err != nil {
+			return nil, rowCount, fmt.Errorf("scan failed: %v", err)
+		}
+		a.Order = *o
+		a.Customer.ID = o.UserID
+		orders = append(orders, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, rowCount, fmt.Errorf("rows error: %v", err)
+	}
+
+	for i := range orders {
+		if err := loadOrderDetails(&orders[i].Order); err != nil {
+			return nil, rowCount, err
+		}
+	}
+
+	return orders, rowCount, nil
+}
+
+func getAdminOrder(id int) (*AdminOrder, error) {
+	var a AdminOrder
+	o, err := scanOrder(db.QueryRow(`
+		select `+orderColumns+`, coalesce(c.viewed, false), coalesce(u.prenom, ''), coalesce(u.nom, ''), coalesce(u.email, ''), coalesce(u.telephone, '')
+		from orders o
+		join carts c on c.id = o.cart_id
+		left join users u on u.id = o.user_id
+		where o.id = $1
+		`, id), &a.Viewed, &a.Customer.Prenom, &a.Customer.Nom, &a.Customer.Email, &a.Customer.Telephone)
+	if err != nil {
+		return nil, err
+	}
+	a.Order = *o
+	a.Customer.ID = o.UserID
+
+	if err := loadOrderDetails(&a.Order); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func markOrdersViewed(ids []int, viewed bool) error {
+	_, err := db.Exec(`
+		update carts set viewed = $2
+		where id in (select cart_id from orders where id = any($1))
+		`, pq.Array(ids), viewed)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+// getUnviewedOrderCounts counts the orders not yet seen by an admin, by state
+func getUnviewedOrderCounts() (map[string]int, int, error) {
+	rows, err := db.Query(`
+		select c.state, count(*)
+		from orders o
+		join carts c on c.id = o.cart_id
+		where not coalesce(c.viewed, false)
+		group by c.state
+		`)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	var total int
+	for rows.Next() {
+		var state CartState
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, 0, fmt.Errorf("scan failed: %v", err)
+		}
+		counts[state.String()] = n
+		total += n
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("rows error: %v", err)
+	}
+
+	return counts, total, nil
+}
+
+// getUserRoles returns the roles granted to a user. Every user is a customer,
+// so that role is implied and never stored.
+func getUserRoles(userID int) ([]string, error) {
+	rows, err := db.Query("select role from user_roles where user_id = $1 order by role", userID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	roles := []string{RoleCustomer}
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		roles = append(roles, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return roles, nil
+}
+
+func grantRole(userID int, role string) error {
+	_, err := db.Exec(`
+		insert into user_roles (user_id, role) values ($1, $2)
+		on conflict do nothing
+		`, userID, role)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return &inputError{"User not found"}
+		}
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	return nil
+}
+
+func revokeRole(userID int, role string) error {
+	if _, err := db.Exec("delete from user_roles where user_id = $1 and role = $2", userID, role); err != nil {
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	return nil
+}
+
+func createSession(userID int, refreshHash string, userAgent string, ip string, ttl time.Duration) (int, error) {
+	var id int
+	err := db.QueryRow(`
+		insert into sessions (user_id, refresh_hash, user_agent, ip, expires_at)
+		values ($1, $2, $3, $4, now() + $5 * interval '1 second')
+		returning id
+		`, userID, refreshHash, userAgent, ip, int(ttl.Seconds())).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("insert failed: %v", err)
+	}
+	return id, nil
+}
+
+var errSessionRevoked = errors.New("Session revoked")
+
+// rotateSession swaps the refresh token of a live session. Presenting a
+// refresh token that was already rotated means it was stolen or replayed, so
+// the whole session is revoked; its id and user are returned with
+// errSessionRevoked.
+func rotateSession(oldHash string, newHash string, ttl time.Duration) (sessionID int, userID int, err error) {
+	err = db.QueryRow(`
+		update sessions
+		set previous_hash = refresh_hash, refresh_hash = $2, last_used_at = now(),
+		expires_at = now() + $3 * interval '1 second'
+		where refresh_hash = $1 and revoked_at is null and expires_at > now()
+		returning id, user_id
+		`, oldHash, newHash, int(ttl.Seconds())).Scan(&sessionID, &userID)
+	if err == nil {
+		return sessionID, userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("update failed: %v", err)
+	}
+
+	err = db.QueryRow(`
+		update sessions set revoked_at = now()
+		where previous_hash = $1 and revoked_at is null
+		returning id, user_id
+		`, oldHash).Scan(&sessionID, &userID)
+	if err == sql.ErrNoRows {
+		return 0, 0, sql.ErrNoRows
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("update failed: %v", err)
+	}
+	return sessionID, userID, errSessionRevoked
+}
+
+func isSessionActive(sessionID int, userID int) (bool, error) {
+	var active bool
+	err := db.QueryRow(`
+		select exists (
+		select 1 from sessions
+		where id = $1 and user_id = $2 and revoked_at is null and expires_at > now()
+		)
+		`, sessionID, userID).Scan(&active)
+	if err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	return active, nil
+}
+
+func revokeSession(sessionID int, userID int) error {
+	_, err := db.Exec(`
+		update sessions set revoked_at = now()
+		where id = $1 and user_id = $2 and revoked_at is null
+		`, sessionID, userID)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+// revokeUserSessions revokes every session of a user except keepID (0 keeps
+// none) and returns how many were revoked.
+func revokeUserSessions(userID int, keepID int) (int, error) {
+	res, err := db.Exec(`
+		update sessions set revoked_at = now()
+		where user_id = $1 and id != $2 and revoked_at is null
+		`, userID, keepID)
+	if err != nil {
+		return 0, fmt.Errorf("update failed: %v", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+func getActiveSessions(userID int) ([]Session, error) {
+	rows, err := db.Query(`
+		select id, user_agent, ip, created_at, last_used_at
+		from sessions
+		where user_id = $1 and revoked_at is null and expires_at > now()
+		order by last_used_at desc
+		`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		s.CreatedAt = formatFrenchDate(s.CreatedAt)
+		s.LastUsedAt = formatFrenchDate(s.LastUsedAt)
+		sessions = append(sessions, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return sessions, nil
+}
+
+func createPasswordReset(userID int, tokenHash string, ttl time.Duration) error {
+	_, err := db.Exec(`
+		insert into password_resets (user_id, token_hash, expires_at)
+		values ($1, $2, now() + $3 * interval '1 second')
+		`, userID, tokenHash, int(ttl.Seconds()))
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	return nil
+}
+
+// resetPassword consumes a reset token and stores the new password hash. All
+// other pending tokens of the user are burnt and their sessions revoked.
+func resetPassword(tokenHash string, passwordHash string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`
+		update password_resets set used_at = now()
+		where token_hash = $1 and used_at is null and expires_at > now()
+		returning user_id
+		`, tokenHash).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, &inputError{"Invalid or expired reset link"}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("update failed: %v", err)
+	}
+
+	if _, err := tx.Exec("update users set password = $1 where id = $2", passwordHash, userID); err != nil {
+		return 0, fmt.Errorf("update failed: %v", err)
+	}
+	if _, err := tx.Exec("update password_resets set used_at = now() where user_id = $1 and used_at is null", userID); err != nil {
+		return 0, fmt.Errorf("update failed: %v", err)
+	}
+	if _, err := tx.Exec("update sessions set revoked_at = now() where user_id = $1 and revoked_at is null", userID); err != nil {
+		return 0, fmt.Errorf("update failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit failed: %v", err)
+	}
+	return userID, nil
+}
+
+// createEmailVerification stores a pending verification of email for the
+// user, replacing the unused ones sent to the same address. A new email
+// change also replaces the pending change to another address, but resending
+// the link for the current address leaves a pending change alone.
+func createEmailVerification(userID int, email string, tokenHash string, ttl time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		delete from email_verifications v
+		using users u
+		where v.user_id = $1 and u.id = v.user_id and v.used_at is null
+		and (lower(v.email) = lower($2)
+		or (lower(v.email) <> lower(u.email) and lower($2) <> lower(u.email)))
+		`, userID, email)
+	if err != nil {
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	_, err = tx.Exec(`
+		insert into email_verifications (user_id, email, token_hash, expires_at)
+		values ($1, $2, $3, now() + $4 * interval '1 second')
+		`, userID, email, tokenHash, int(ttl.Seconds()))
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// verifyEmail consumes a verification token and marks the email it was sent
+// to as the user's verified email
+func verifyEmail(tokenHash string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	err = tx.QueryRow(`
+		update email_verifications set used_at = now()
+		where token_hash = $1 and used_at is null and expires_at > now()
+		returning user_id, email
+		`, tokenHash).Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		return &inputError{"Invalid or expired verification link"}
+	}
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+
+	var previous string
+	if err := tx.QueryRow("select email from users where id = $1 for update", userID).Scan(&previous); err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	_, err = tx.Exec("update users set email = $1, email_verified = true where id = $2", email, userID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return &inputError{"This email is already used by another account"}
+		}
+		return fmt.Errorf("update failed: %v", err)
+	}
+	// After a change, links still pending for the old address must not
+	// switch the account back
+	if !strings.EqualFold(previous, email) {
+		if _, err := tx.Exec("delete from email_verifications where user_id = $1 and used_at is null", userID); err != nil {
+			return fmt.Errorf("delete failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+func isEmailVerified(userID int) (bool, error) {
+	var verified bool
+	if err := db.QueryRow("select email_verified from users where id = $1", userID).Scan(&verified); err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	return verified, nil
+}
+
+// getUserIDByPhone finds the user whose verified telephone matches an E.164
+// Senegalese number. Stored numbers may be in any format, so only their last
+// 9 digits are compared; users_verified_telephone keeps them unique.
+func getUserIDByPhone(phone string) (int, error) {
+	var id int
+	err := db.QueryRow(`
+		select id from users
+		where telephone_verified
+		and right(regexp_replace(coalesce(telephone, ''), '\D', '', 'g'), 9) = $1
+		`, strings.TrimPrefix(phone, "+221")).Scan(&id)
+	return id, err
+}
+
+// verifyUserPhone marks telephone as the user's confirmed number, as long as
+// it is still the one on the profile. Another account that had confirmed the
+// same number loses it: the number now answers to this user.
+func verifyUserPhone(userID int, telephone string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		update users set telephone_verified = false
+		where id != $1 and telephone_verified
+		and right(regexp_replace(coalesce(telephone, ''), '\D', '', 'g'), 9) = right(regexp_replace($2, '\D', '', 'g'), 9)
+		`, userID, telephone)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	res, err := tx.Exec("update users set telephone_verified = true where id = $1 and telephone = $2", userID, telephone)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return &inputError{"Your phone number changed, request a new code"}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// createPhoneOTP stores a new code for purpose (login or verify), refusing to
+// send another one to the number before resendDelay has passed. Older pending
+// codes of the same purpose are invalidated.
+func createPhoneOTP(userID int, phone string, purpose string, codeHash string, ttl time.Duration, resendDelay time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var recent bool
+	err = tx.QueryRow(`
+		select exists (
+		select 1 from phone_otps
+		where phone = $1 and created_at > now() - $2 * interval '1 second'
+		)
+		`, phone, int(resendDelay.Seconds())).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+	if recent {
+		return &inputError{"Please wait before requesting a new code"}
+	}
+
+	_, err = tx.Exec("update phone_otps set used_at = now() where phone = $1 and purpose = $2 and used_at is null", phone, purpose)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	_, err = tx.Exec(`
+		insert into phone_otps (user_id, phone, purpose, code_hash, expires_at)
+		values ($1, $2, $3, $4, now() + $5 * interval '1 second')
+		`, userID, phone, purpose, codeHash, int(ttl.Seconds()))
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+// consumePhoneOTP checks a code against the pending one for phone and
+// purpose. Every wrong guess counts; after maxAttempts the code is burnt.
+func consumePhoneOTP(phone string, purpose string, code string, maxAttempts int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var id, userID, attempts int
+	var codeHash string
+	err = tx.QueryRow(`
+		select id, user_id, code_hash, attempts
+		from phone_otps
+		where phone = $1 and purpose = $2 and used_at is null and expires_at > now()
+		order by created_at desc
+		limit 1
+		for update
+		`, phone, purpose).Scan(&id, &userID, &codeHash, &attempts)
+	if err == sql.ErrNoRows {
+		return 0, &inputError{"Invalid or expired code"}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %v", err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(code)) != nil {
+		attempts++
+		_, err := tx.Exec(`
+			update phone_otps set attempts = $2, used_at = case when $2 >= $3 then now() end
+			where id = $1
+			`, id, attempts, maxAttempts)
+		if err != nil {
+			return 0, fmt.Errorf("update failed: %v", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("commit failed: %v", err)
+		}
+		return 0, &inputError{"Invalid or expired code"}
+	}
+
+	if _, err := tx.Exec("update phone_otps set used_at = now() where id = $1", id); err != nil {
+		return 0, fmt.Errorf("update failed: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit failed: %v", err)
+	}
+	return userID, nil
+}
+
+func recordLimitEvent(key string, event string, ip string, lockedUntil *time.Time) {
+	_, err := db.Exec(`
+		insert into limit_events (key, event, ip, locked_until)
+		values ($1, $2, $3, $4)
+		`, key, event, ip, lockedUntil)
+	if err != nil {
+		log.Println("Failed to record limit event:", err)
+	}
+}
+
+// getActiveLockouts lists the keys whose lockout has not expired yet
+func getActiveLockouts() ([]LimitEvent, error) {
+	rows, err := db.Query(`
+		select distinct on (key) key, event, ip, to_char(locked_until, 'YYYY-MM-DD"T"HH24:MI:SSOF'), created_at
+		from limit_events
+		where event = 'lockout' and locked_until > now()
+		order by key, created_at desc
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	events := []LimitEvent{}
+	for rows.Next() {
+		var e LimitEvent
+		if err := rows.Scan(&e.Key, &e.Event, &e.IP, &e.LockedUntil, &e.Date); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		e.Date = formatFrenchDate(e.Date)
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return events, nil
+}
+
+func clearLockout(key string) error {
+	if err := limiterStore.Delete(key); err != nil {
+		return err
+	}
+	_, err := db.Exec("update limit_events set locked_until = now() where key = $1 and locked_until > now()", key)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+// saveTOTPEnrollment stores a new, not yet enabled secret and replaces the
+// recovery codes. An enabled second factor must be disabled first.
+func saveTOTPEnrollment(userID int, secret string, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		insert into user_totp (user_id, secret)
+		values ($1, $2)
+		on conflict (user_id) do update
+		set secret = excluded.secret, last_step = 0, created_at = now()
+		where not user_totp.enabled
+		`, userID, secret)
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return &inputError{"Two-factor authentication is already enabled"}
+	}
+
+	if _, err := tx.Exec("delete from recovery_codes where user_id = $1", userID); err != nil {
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.Exec("insert into recovery_codes (user_id, code_hash) values ($1, $2)", userID, h); err != nil {
+			return fmt.Errorf("insert failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+func isTOTPEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow("select exists (select 1 from user_totp where user_id = $1 and enabled)", userID).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	return enabled, nil
+}
+
+// checkSecondFactor accepts a TOTP code, or one of the recovery codes when
+// allowRecovery is set. A TOTP code cannot be replayed: steps at or before
+// the last accepted one are refused.
+func checkSecondFactor(userID int, code string, allowRecovery bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var lastStep int64
+	err = tx.QueryRow(`
+		select secret, last_step from user_totp
+		where user_id = $1
+		for update
+		`, userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return &inputError{"Two-factor authentication is not set up"}
+	}
+	if err != nil {
+		return fmt.Errorf("query failed: %v", err)
+	}
+
+	if step := matchTOTP(secret, code, time.Now()); step > lastStep {
+		if _, err := tx.Exec("update user_totp set last_step = $2 where user_id = $1", userID, step); err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+	} else if !allowRecovery {
+		return &inputError{"Invalid code"}
+	} else {
+		res, err := tx.Exec(`
+			update recovery_codes set used_at = now()
+			where user_id = $1 and code_hash = $2 and used_at is null
+			`, userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return fmt.Errorf("update failed: %v", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return &inputError{"Invalid code"}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+func setTOTPEnabled(userID int, enabled bool) error {
+	_, err := db.Exec("update user_totp set enabled = $2 where user_id = $1", userID, enabled)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	if !enabled {
+		if _, err := db.Exec("delete from recovery_codes where user_id = $1", userID); err != nil {
+			return fmt.Errorf("delete failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func countRecoveryCodes(userID int) (int, error) {
+	var n int
+	err := db.QueryRow("select count(*) from recovery_codes where user_id = $1 and used_at is null", userID).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("query failed: %v", err)
+	}
+	return n, nil
+}
+
+type storedJWTKey struct {
+	ID         string
+	PrivateKey string
+	Active     bool // signs tokens, as opposed to pending or retired keys
+}
+
+// getJWTKeys returns the keys of an algorithm, oldest first, so the last
+// active one is the current signing key
+func getJWTKeys(alg string) ([]storedJWTKey, error) {
+	rows, err := db.Query(`
+		select kid, private_key, activates_at <= now() and (retired_at is null or retired_at > now())
+		from jwt_keys
+		where alg = $1
+		order by created_at
+		`, alg)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []storedJWTKey{}
+	for rows.Next() {
+		var k storedJWTKey
+		if err := rows.Scan(&k.ID, &k.PrivateKey, &k.Active); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		keys = append(keys, k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return keys, nil
+}
+
+func updateJWTPrivateKey(kid string, privateKey string) error {
+	if _, err := db.Exec("update jwt_keys set private_key = $2 where kid = $1", kid, privateKey); err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+// rotateJWTKey adds a key from generate when the newest key of alg is older
+// than every, and drops keys retired for longer than retention. The new key
+// only signs after lead, so that it is published before any token uses it;
+// the previous key retires at that moment. When no key is active yet the new
+// one signs right away. An advisory lock keeps instances from rotating
+// together.
+func rotateJWTKey(alg string, every time.Duration, lead time.Duration, retention time.Duration, generate func() (string, string, error)) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("select pg_advisory_xact_lock(hashtext('jwt_keys'))"); err != nil {
+		return false, fmt.Errorf("lock failed: %v", err)
+	}
+
+	var fresh, active bool
+	err = tx.QueryRow(`
+		select
+		exists (
+		select 1 from jwt_keys
+		where alg = $1 and created_at > now() - $2 * interval '1 second'
+		),
+		exists (
+		select 1 from jwt_keys
+		where alg = $1 and activates_at <= now() and (retired_at is null or retired_at > now())
+		)
+		`, alg, int64(every.Seconds())).Scan(&fresh, &active)
+	if err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	if fresh && active {
+		return false, nil
+	}
+	if !active {
+		lead = 0
+	}
+
+	kid, privateKey, err := generate()
+	if err != nil {
+		return false, fmt.Errorf("key generation failed: %v", err)
+	}
+	_, err = tx.Exec(`
+		update jwt_keys
+		set retired_at = now() + $2 * interval '1 second'
+		where alg = $1 and retired_at is null
+		`, alg, int64(lead.Seconds()))
+	if err != nil {
+		return false, fmt.Errorf("update failed: %v", err)
+	}
+	_, err = tx.Exec(`
+		insert into jwt_keys (kid, alg, private_key, activates_at)
+		values ($1, $2, $3, now() + $4 * interval '1 second')
+		`, kid, alg, privateKey, int64(lead.Seconds()))
+	if err != nil {
+		return false, fmt.Errorf("insert failed: %v", err)
+	}
+	_, err = tx.Exec(`
+		delete from jwt_keys
+		where retired_at < now() - $1 * interval '1 second'
+		`, int64(retention.Seconds()))
+	if err != nil {
+		return false, fmt.Errorf("delete failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("commit failed: %v", err)
+	}
+	return true, nil
+}
+
+// updateProfile saves the profile; a new phone number must be confirmed again
+func updateProfile(userID int, prenom string, nom string, telephone string) error {
+	_, err := db.Exec(`
+		update users
+		set prenom = $2, nom = $3, telephone = $4,
+		telephone_verified = telephone_verified and telephone is not distinct from $4
+		where id = $1
+		`, userID, prenom, nom, telephone)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+func isEmailTaken(email string, exceptUserID int) (bool, error) {
+	var taken bool
+	err := db.QueryRow("select exists (select 1 from users where lower(email) = lower($1) and id != $2)", email, exceptUserID).Scan(&taken)
+	if err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	return taken, nil
+}
+
+func getPasswordHash(userID int) (string, error) {
+	var hash string
+	if err := db.QueryRow("select password from users where id = $1", userID).Scan(&hash); err != nil {
+		return "", fmt.Errorf("query failed: %v", err)
+	}
+	return hash, nil
+}
+
+// changePassword sets a new password and revokes every session but keepID
+func changePassword(userID int, passwordHash string, keepID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("update users set password = $1 where id = $2", passwordHash, userID); err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	_, err = tx.Exec(`
+		update sessions set revoked_at = now()
+		where user_id = $1 and id != $2 and revoked_at is null
+		`, userID, keepID)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit failed: %v", err)
+	}
+	return nil
+}
+
+func getUserComments(userID int) ([]ExportedComment, error) {
+	rows, err := db.Query(`
+		select c.id, c.article_id, coalesce(a.title, ''), c."date", coalesce(c."comment", '')
+		from "comments" c
+		left join articles a on a.id = c.article_id
+		where c.user_id = $1
+		order by c."date"
+		`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	comments := []ExportedComment{}
+	for rows.Next() {
+		var c ExportedComment
+		if err := rows.Scan(&c.ID, &c.ArticleID, &c.ArticleTitle, &c.Date, &c.Comment); err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		comments = append(comments, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return comments, nil
+}
+
+func getUserCarts(userID int) ([]Cart, error) {
+	rows, err := db.Query(`
+		select id, user_id, content, created_at, state, viewed
+		from carts
+		where user_id = $1
+		order by id
+		`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	carts := []Cart{}
+	for rows.Next() {
+		cart, err := scanCart(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		carts = append(carts, *cart)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return carts, nil
+}
+
+// hasOrdersInProgress reports orders that are paid or awaiting payment but
+// not delivered yet: the courier still needs the customer's details
+func hasOrdersInProgress(userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		select exists (
+		select 1 from orders o
+		join carts c on c.id = o.cart_id
+		where o.user_id = $1 and c.state = any($2)
+		)
+		`, userID, pq.Array([]int{int(CartStateCheckedOut), int(CartStatePaid), int(CartStatePreparing), int(CartStateShipped)})).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("query failed: %v", err)
+	}
+	return exists, nil
+}
+
+// anonymizeUser erases a user's personal data. The users row is kept, with
+// placeholder values, so that comments, orders and state history still point
+// to it; orders keep their amounts but lose the delivery details. Returns the
+// old avatar URL so the file can be removed.
+func anonymizeUser(userID int) (string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("begin failed: %v", err)
+	}
+	defer tx.Rollback()
+
+	var avatarURL sql.NullString
+	err = tx.QueryRow(`
+		update users u
+		set prenom = 'Utilisateur', nom = 'supprimé', telephone = null,
+		email = 'deleted-' || u.id || '@deleted.invalid', password = '',
+		avatar_url = null, email_verified = false, does_login = false, deleted_at = now()
+		from (select avatar_url from users where id = $1) old
+		where u.id = $1
+		returning old.avatar_url
+		`, userID).Scan(&avatarURL)
+	if err != nil {
+		return "", fmt.Errorf("update failed: %v", err)
+	}
+
+	_, err = tx.Exec(`
+		update orders
+		set shipping_address = shipping_address - 'label' - 'recipient' - 'telephone' - 'quartier' - 'landmark'
+		where user_id = $1 and shipping_address is not null
+		`, userID)
+	if err != nil {
+		return "", fmt.Errorf("update failed: %v", err)
+	}
+
+	cleanup := []string{
+		"delete from carts c where c.user_id = $1 and not exists (select 1 from orders o where o.cart_id = c.id)",
+		"delete from addresses where user_id = $1",
+		"delete from sessions where user_id = $1",
+		"delete from user_roles where user_id = $1",
+		"delete from user_totp where user_id = $1",
+		"delete from recovery_codes where user_id = $1",
+		"delete from email_verifications where user_id = $1",
+		"delete from password_resets where user_id = $1",
+		"delete from phone_otps where user_id = $1",
+	}
+	for _, q := range cleanup {
+		if _, err := tx.Exec(q, userID); err != nil {
+			return "", fmt.Errorf("delete failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("commit failed: %v", err)
+	}
+	return avatarURL.String, nil
+}
+
+func insertAuditEntry(action string, actorID *int, apiKeyID *int, targetType string, targetID string, ip string, userAgent string, details interface{}) error {
+	detailsJSON := []byte("{}")
+	if details != nil {
+		var err error
+		if detailsJSON, err = json.Marshal(details); err != nil {
+			return fmt.Errorf("marshal details failed: %v", err)
+		}
+	}
+	_, err := db.Exec(`
+		insert into audit_log (action, actor_id, actor_api_key_id, target_type, target_id, ip, user_agent, details)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, action, actorID, apiKeyID, targetType, targetID, ip, userAgent, detailsJSON)
+	if err != nil {
+		return fmt.Errorf("insert failed: %v", err)
+	}
+	return nil
+}
+
+func getAuditEntries(f AuditFilter, offset int, siz int) ([]AuditEntry, int, error) {
+	rows, err := db.Query(`
+		select id, to_char(created_at, 'YYYY-MM-DD"T"HH24:MI:SSOF'), action, actor_id, actor_api_key_id, target_type, target_id, ip, user_agent, details,
+		COUNT(*) OVER()
+		from audit_log
+		where ($3 = '' or action = $3)
+		and ($4 = 0 or actor_id = $4)
+		and ($5 = '' or target_type = $5)
+		and ($6 = '' or target_id = $6)
+		and ($7 = '' or ip = $7)
+		and (nullif($8, '')::date is null or created_at >= nullif($8, '')::date)
+		and (nullif($9, '')::date is null or created_at < nullif($9, '')::date + 1)
+		and ($10 = 0 or actor_api_key_id = $10)
+		order by created_at desc, id desc
+		OFFSET $1 ROWS FETCH NEXT $2 ROWS ONLY
+		`, offset, siz, f.Action, f.ActorID, f.TargetType, f.TargetID, f.IP, f.From, f.To, f.APIKeyID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	var rowCount int
+	for rows.Next() {
+		var e AuditEntry
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.Date, &e.Action, &e.ActorID, &e.ActorAPIKeyID, &e.TargetType, &e.TargetID, &e.IP, &e.UserAgent, &details, &rowCount); err != nil {
+			return nil, rowCount, fmt.Errorf("scan failed: %v", err)
+		}
+		e.Details = json.RawMessage(details)
+		entries = append(entries, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, rowCount, fmt.Errorf("rows error: %v", err)
+	}
+
+	return entries, rowCount, nil
+}
+
+const apiKeyColumns = `id, name, prefix, scopes, created_by,
+		to_char(created_at, 'YYYY-MM-DD"T"HH24:MI:SSOF'),
+		to_char(expires_at, 'YYYY-MM-DD"T"HH24:MI:SSOF'),
+		to_char(last_used_at, 'YYYY-MM-DD"T"HH24:MI:SSOF'),
+		to_char(revoked_at, 'YYYY-MM-DD"T"HH24:MI:SSOF')`
+
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (*APIKey, error) {
+	var k APIKey
+	err := scanner.Scan(&k.ID, &k.Name, &k.Prefix, pq.Array(&k.Scopes), &k.CreatedBy,
+		&k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func createAPIKey(name string, prefix string, keyHash string, scopes []string, createdBy int, ttl time.Duration) (*APIKey, error) {
+	var expires interface{}
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	k, err := scanAPIKey(db.QueryRow(`
+		insert into api_keys (name, prefix, key_hash, scopes, created_by, expires_at)
+		values ($1, $2, $3, $4, $5, $6)
+		returning `+apiKeyColumns,
+		name, prefix, keyHash, pq.Array(scopes), createdBy, expires))
+	if err != nil {
+		return nil, fmt.Errorf("insert failed: %v", err)
+	}
+	return k, nil
+}
+
+func getAPIKeys() ([]APIKey, error) {
+	rows, err := db.Query(`
+		select ` + apiKeyColumns + `
+		from api_keys
+		order by revoked_at is not null, created_at desc
+		`)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %v", err)
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan failed: %v", err)
+		}
+		keys = append(keys, *k)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %v", err)
+	}
+
+	return keys, nil
+}
+
+func revokeAPIKey(id int) error {
+	res, err := db.Exec("update api_keys set revoked_at = now() where id = $1 and revoked_at is null", id)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// useAPIKey finds a valid key by hash and records that it was used. The
+// last use is only written once a minute, not on every request.
+func useAPIKey(keyHash string) (*APIKey, error) {
+	k, err := scanAPIKey(db.QueryRow(`
+		select `+apiKeyColumns+`
+		from api_keys
+		where key_hash = $1 and revoked_at is null and (expires_at is null or expires_at > now())
+		`, keyHash))
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		update api_keys set last_used_at = now()
+		where id = $1 and (last_used_at is null or last_used_at < now() - interval '1 minute')
+		`, k.ID)
+	if err != nil {
+		return nil, fmt.Errorf("update failed: %v", err)
+	}
+	return k, nil
+}
+
+// updateProductStock sets the quantity and/or price of a product
+func updateProductStock(sku string, quantity *int, price *int) (int, int, error) {
+	var q, p int
+	err := db.QueryRow(`
+		update products
+		set quantity = coalesce($2, quantity), price = coalesce($3, price)
+		where sku = $1
+		returning coalesce(quantity, 0), coalesce(price, 0)
+		`, sku, quantity, price).Scan(&q, &p)
+	return q, p, err
+}
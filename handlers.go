@@ -1,40 +1,97 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/big"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET"))
-
 func signupHandler(c *gin.Context) {
-	var user User
+	// Every signup counts, successful or not, to slow down account spam
+	limits := map[string]LimitPolicy{"signup:ip:" + c.ClientIP(): signupIPPolicy}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+
+	// User hides its password from JSON, so signups bind their own struct
+	var user SignupRequestInfo
 	if err := c.BindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
 		return
 	}
 
+	if errs := validateSignup(&user); len(errs) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Certains champs sont invalides", "fields": errs})
+		return
+	}
+
+	// The unique constraint is case sensitive and older accounts may hold
+	// mixed case emails
+	taken, err := isEmailTaken(user.Email, 0)
+	if err != nil {
+		log.Println("Failed to create user:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Un compte existe déjà avec ces informations",
+			"fields": FieldErrors{"email": "Cette adresse email est déjà utilisée"},
+		})
+		return
+	}
+
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 8)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
 	}
 
-	_, err = db.Exec(
-		"INSERT INTO users (prenom, nom, telephone, email, password) VALUES ($1, $2, $3, $4, $5)",
-		user.Prenom, user.Nom, user.Telephone, user.Email, string(hashedPassword))
+	var userID int
+	err = db.QueryRow(
+		"INSERT INTO users (prenom, nom, telephone, email, password, email_verified) VALUES ($1, $2, $3, $4, $5, false) RETURNING id",
+		user.Prenom, user.Nom, user.Telephone, user.Email, string(hashedPassword)).Scan(&userID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":  "Un compte existe déjà avec ces informations",
+			"fields": FieldErrors{"email": "Cette adresse email est déjà utilisée"},
+		})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		log.Println("Failed to create user:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
+	if err := sendVerificationEmail(userID, user.Email); err != nil {
+		log.Println("Failed to send verification email:", err)
+	}
+
 	c.JSON(http.StatusCreated, gin.H{"message": "User created successfully"})
 }
 
@@ -45,34 +102,90 @@ func loginHandler(c *gin.Context) {
 		return
 	}
 
+	creds.Email = normalizeEmail(creds.Email)
+	accountKey := "login:account:" + creds.Email
+	limits := map[string]LimitPolicy{
+		"login:ip:" + c.ClientIP(): loginIPPolicy,
+		accountKey:                 loginAccountPolicy,
+	}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+
 	var user User
-	row := db.QueryRow("SELECT id, email, password, avatar_url FROM users WHERE email = $1", creds.Email)
+	row := db.QueryRow("SELECT id, email, password, coalesce(avatar_url, '') FROM users WHERE lower(email) = $1 ORDER BY email = $1 DESC, id LIMIT 1", creds.Email)
 	if err := row.Scan(&user.ID, &user.Email, &user.Password, &user.AvatarURL); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		loginFailed(c, "email", auditHash(creds.Email))
 		return
 	}
 
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		loginFailed(c, "user", strconv.Itoa(user.ID))
 		return
 	}
 
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		UserID: user.ID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	limitSucceeded(limits)
+	if err := limiterStore.Delete(accountKey); err != nil {
+		log.Println("Failed to reset login limiter:", err)
+	}
+
+	completeLogin(c, user.ID)
+}
+
+// completeLogin opens a session for an authenticated user, merges their guest
+// cart and answers with the tokens. Users with a second factor get a partial
+// token instead, to be upgraded through /login/2fa.
+func completeLogin(c *gin.Context, userID int) {
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if enabled {
+		partial, err := newTwoFactorToken(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"twoFactorRequired": true, "partialToken": partial})
+		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	finishLogin(c, userID)
+}
+
+func finishLogin(c *gin.Context, userID int) {
+	tokens, err := startSession(c, userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
 		return
 	}
+	recordAudit(c, AuditLogin, userID, "user", strconv.Itoa(userID), gin.H{"via": c.FullPath()})
+
+	if cartID, err := parseCartToken(cartTokenFromRequest(c)); err == nil {
+		if err := mergeGuestCart(cartID, userID); err != nil {
+			log.Println("Failed to merge guest cart:", err)
+		}
+		setCookie(c, cartCookieName, "", "/", -1, true)
+	}
+
+	respondTokens(c, tokens, wantsCookieSession(c))
+}
+
+// respondTokens returns the tokens in the body, or sets them as cookies and
+// returns only the CSRF token in cookie mode
+func respondTokens(c *gin.Context, tokens *AuthTokens, cookieMode bool) {
+	if !cookieMode {
+		c.JSON(http.StatusOK, tokens)
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"token": tokenString})
+	csrf, err := setSessionCookies(c, tokens)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"csrfToken": csrf, "expiresIn": tokens.ExpiresIn})
 }
 
 func dashboardHandler(c *gin.Context) {
@@ -93,6 +206,7 @@ func dashboardHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user type in context"})
 		return
 	} 
+	user.Roles = _user.Roles
 
 	c.JSON(http.StatusOK, user)
 }
@@ -135,34 +249,140 @@ func uploadAvatarHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"avatarUrl": avatarURL})
 }
 
+const (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// AuthTokens is what a successful login returns
+type AuthTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+	ExpiresIn    int    `json:"expiresIn"` // seconds
+}
+
+// newAuthToken issues the short-lived JWT of a session, with the user's
+// current roles
+func newAuthToken(userID int, sessionID int) (string, error) {
+	roles, err := getUserRoles(userID)
+	if err != nil {
+		return "", err
+	}
+
+	expirationTime := time.Now().Add(accessTokenTTL)
+	claims := &Claims{
+		UserID:    userID,
+		Roles:     roles,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+		},
+	}
+
+	return keyManager.Sign(claims)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// startSession opens a session for the device making the request and returns
+// its access and refresh tokens. Only the hash of the refresh token is stored.
+func startSession(c *gin.Context, userID int) (*AuthTokens, error) {
+	refresh, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	sessionID, err := createSession(userID, hashToken(refresh), c.Request.UserAgent(), c.ClientIP(), refreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	token, err := newAuthToken(userID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthTokens{Token: token, RefreshToken: refresh, ExpiresIn: int(accessTokenTTL.Seconds())}, nil
+}
+
+// userFromToken validates a JWT, checks that its session is still active and
+// loads the user it was issued for
+func userFromToken(tokenStr string) (User, *Claims, error) {
+	var user User
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keyManager.Keyfunc)
+
+	if err != nil || !token.Valid {
+		return user, nil, errors.New("Invalid token")
+	}
+
+	active, err := isSessionActive(claims.SessionID, claims.UserID)
+	if err != nil || !active {
+		return user, nil, errors.New("Session revoked")
+	}
+
+	row := db.QueryRow("SELECT id, email, coalesce(avatar_url, '') FROM users WHERE id = $1", claims.UserID)
+	if err := row.Scan(&user.ID, &user.Email, &user.AvatarURL); err != nil {
+		return user, nil, errors.New("User not found")
+	}
+	user.Roles = claims.Roles
+
+	return user, claims, nil
+}
+
 // jwtMiddleware protects routes that require authentication
 func jwtMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tokenStr := c.GetHeader("Authorization")
+		tokenStr, fromCookie := requestToken(c)
 		if tokenStr == "" {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing auth token"})
 			return
 		}
-
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		if fromCookie && !validCSRF(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid CSRF token"})
 			return
 		}
 
-		var user User
-		row := db.QueryRow("SELECT id, email, avatar_url FROM users WHERE id = $1", claims.UserID)
-		if err := row.Scan(&user.ID, &user.Email, &user.AvatarURL); err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		user, claims, err := userFromToken(tokenStr)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Add user to context
-		c.Set("user", user)
+		setUserContext(c, user, claims)
+		c.Next()
+	}
+}
+
+// setUserContext adds the user, their claims and the matching principal to
+// the context
+func setUserContext(c *gin.Context, user User, claims *Claims) {
+	p := Principal{Kind: PrincipalUser, UserID: user.ID, Name: user.Email, Roles: user.Roles, Scopes: []string{}}
+	if hasRole(user, RoleAdmin) {
+		p.Scopes = apiScopes
+	}
+	c.Set("user", user)
+	c.Set("claims", claims)
+	c.Set("principal", p)
+}
+
+// optionalJWTMiddleware adds the user to the context when a valid token is
+// sent, and lets anonymous requests through otherwise
+func optionalJWTMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if tokenStr, fromCookie := requestToken(c); tokenStr != "" {
+			if fromCookie && !validCSRF(c) {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid CSRF token"})
+				return
+			}
+			user, claims, err := userFromToken(tokenStr)
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			setUserContext(c, user, claims)
+		}
 		c.Next()
 	}
 }
@@ -264,3 +484,2379 @@ func articleSearchHandler(c *gin.Context) {
 	}
 	c.JSON(http.StatusOK, gin.H{"articles": ars, "pages": (nRows / 12)+1} )
 }
+
+type ProductFilter struct {
+	Page       int    `form:"page"`
+	Collection int    `form:"collection"`
+	Category   int    `form:"category"`
+	Color      string `form:"color"`
+	Size       string `form:"size"`
+	MinPrice   int    `form:"minPrice"`
+	MaxPrice   int    `form:"maxPrice"`
+}
+
+func productsHandler(c *gin.Context) {
+	var info ProductFilter
+	if err := c.ShouldBind(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filters"})
+		return
+	}
+	if info.Page <= 0 {
+		info.Page = 1
+	}
+
+	products, s, err := getProducts(info, (info.Page-1)*12, 12)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"products": products, "pages": (s / 12)+1})
+}
+
+func getProductDetail(c *gin.Context) {
+	sku := c.Param("sku")
+	product, err := getProductDetailData(sku)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, product)
+}
+
+// currentUser returns the user stored in the context by jwtMiddleware
+func currentUser(c *gin.Context) (User, bool) {
+	userCtx, exists := c.Get("user")
+	if !exists {
+		return User{}, false
+	}
+	user, ok := userCtx.(User)
+	return user, ok
+}
+
+// respondError answers 400 for input errors and 500 for everything else
+func respondError(c *gin.Context, err error) {
+	var ie *inputError
+	if errors.As(err, &ie) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ie.Error()})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+func respondCart(c *gin.Context, cart *Cart) {
+	view, err := getCartView(cart)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+const (
+	cartHeaderName = "X-Cart-Token"
+	cartCookieName = "cart_token"
+	cartTokenTTL   = 30 * 24 * time.Hour
+)
+
+func newCartToken(cartID int) (string, error) {
+	claims := &CartClaims{
+		CartID: cartID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "cart",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(cartTokenTTL)),
+		},
+	}
+	return keyManager.Sign(claims)
+}
+
+func parseCartToken(tokenStr string) (int, error) {
+	if tokenStr == "" {
+		return 0, errors.New("Missing cart token")
+	}
+	claims := &CartClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keyManager.Keyfunc)
+	if err != nil || !token.Valid || claims.Subject != "cart" || claims.CartID == 0 {
+		return 0, errors.New("Invalid cart token")
+	}
+	return claims.CartID, nil
+}
+
+// cartTokenFromRequest reads the guest cart token from the header, falling
+// back to the cookie
+func cartTokenFromRequest(c *gin.Context) string {
+	if t := c.GetHeader(cartHeaderName); t != "" {
+		return t
+	}
+	t, _ := c.Cookie(cartCookieName)
+	return t
+}
+
+// userCart loads the active cart of the authenticated user, or the guest cart
+// designated by the cart token. A new guest cart and token are issued when the
+// request carries neither. The request is answered on failure.
+func userCart(c *gin.Context, create bool) (*Cart, bool) {
+	if user, ok := currentUser(c); ok {
+		cart, err := getActiveCart(user.ID)
+		if err != nil {
+			respondError(c, err)
+			return nil, false
+		}
+		return cart, true
+	}
+
+	if cartID, err := parseCartToken(cartTokenFromRequest(c)); err == nil {
+		cart, err := getGuestCart(cartID)
+		if err == nil {
+			return cart, true
+		}
+		if err != sql.ErrNoRows {
+			respondError(c, fmt.Errorf("query failed: %v", err))
+			return nil, false
+		}
+	}
+
+	// Reads get an empty cart that is not saved, so that crawlers and quotes
+	// do not fill the carts table; the row is created on the first write
+	if !create {
+		return &Cart{Content: []CartItem{}, State: CartStateOpen}, true
+	}
+
+	cart, err := createGuestCart()
+	if err != nil {
+		respondError(c, err)
+		return nil, false
+	}
+	token, err := newCartToken(cart.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart token"})
+		return nil, false
+	}
+	c.Header(cartHeaderName, token)
+	setCookie(c, cartCookieName, token, "/", cartTokenTTL, true)
+	return cart, true
+}
+
+func getCartHandler(c *gin.Context) {
+	cart, ok := userCart(c, false)
+	if !ok {
+		return
+	}
+	respondCart(c, cart)
+}
+
+func addCartItemHandler(c *gin.Context) {
+	var item CartItem
+	if err := c.BindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if item.Quantity <= 0 {
+		item.Quantity = 1
+	}
+
+	cart, ok := userCart(c, true)
+	if !ok {
+		return
+	}
+	if err := setCartItem(cart, item, true); err != nil {
+		respondError(c, err)
+		return
+	}
+	respondCart(c, cart)
+}
+
+func updateCartItemHandler(c *gin.Context) {
+	var item CartItem
+	if err := c.BindJSON(&item); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	cart, ok := userCart(c, true)
+	if !ok {
+		return
+	}
+	if findCartItem(cart, item) < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product is not in the cart"})
+		return
+	}
+	if err := setCartItem(cart, item, false); err != nil {
+		respondError(c, err)
+		return
+	}
+	respondCart(c, cart)
+}
+
+func removeCartItemHandler(c *gin.Context) {
+	var item CartItem
+	if err := c.ShouldBindQuery(&item); err != nil || item.SKU == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	cart, ok := userCart(c, false)
+	if !ok {
+		return
+	}
+	if err := removeCartItem(cart, item); err != nil {
+		respondError(c, err)
+		return
+	}
+	respondCart(c, cart)
+}
+
+func clearCartHandler(c *gin.Context) {
+	cart, ok := userCart(c, false)
+	if !ok {
+		return
+	}
+	if err := clearCart(cart); err != nil {
+		respondError(c, err)
+		return
+	}
+	respondCart(c, cart)
+}
+
+type CheckoutRequestInfo struct {
+	PaymentMethod string `json:"paymentMethod"`
+	AddressID     int    `json:"addressId"`
+	// used when no saved address is given
+	ShippingDestination
+}
+
+func checkoutHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var info CheckoutRequestInfo
+	if err := c.ShouldBindJSON(&info); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	switch info.PaymentMethod {
+	case "":
+		info.PaymentMethod = PaymentMethodMobileMoney
+	case PaymentMethodMobileMoney, PaymentMethodCashOnDelivery:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown payment method"})
+		return
+	}
+
+	order, err := checkoutCart(user.ID, info)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, order)
+}
+
+type OrdersRequestInfo struct {
+	Page int `form:"page"`
+}
+
+func ordersHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var info OrdersRequestInfo
+	if err := c.ShouldBind(&info); err != nil || info.Page <= 0 {
+		info.Page = 1
+	}
+
+	orders, s, err := getUserOrders(user.ID, (info.Page-1)*12, 12)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "pages": (s / 12)+1})
+}
+
+func orderHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+
+	order, err := getOrder(id)
+	if err == sql.ErrNoRows || (err == nil && order.UserID != user.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+type PayRequestInfo struct {
+	Provider  string `json:"provider"`
+	Telephone string `json:"telephone"`
+}
+
+func payOrderHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	var info PayRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	provider, ok := paymentProviders[info.Provider]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown payment provider"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+	order, err := getOrder(id)
+	if err == sql.ErrNoRows || (err == nil && order.UserID != user.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if order.State != CartStateCheckedOut || order.PaymentMethod != PaymentMethodMobileMoney {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order is not awaiting payment"})
+		return
+	}
+
+	// Only one payment may be pending at a time. An earlier attempt that
+	// failed or expired at the provider is settled first and then replaced.
+	pending, err := getActivePayment(order.ID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err == nil {
+		if p, ok := paymentProviders[pending.Provider]; ok {
+			if result, err := p.Verify(pending.Reference); err == nil {
+				if err := settlePayment(pending, result); err != nil {
+					respondError(c, err)
+					return
+				}
+				pending.Status = result.Status
+			}
+		}
+		if pending.Status == PaymentPending || pending.Status == PaymentSucceeded {
+			c.JSON(http.StatusConflict, gin.H{"error": "A payment is already in progress for this order", "reference": pending.Reference})
+			return
+		}
+	}
+
+	session, err := provider.Initiate(PaymentRequest{OrderID: order.ID, Amount: order.Total, Telephone: info.Telephone})
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to initiate payment"})
+		return
+	}
+	if err := createPayment(order.ID, provider.Name(), session.Reference, order.Total); err != nil {
+		if err == errPaymentInProgress {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+type PaymentWebhookInfo struct {
+	Reference string `json:"reference"`
+}
+
+// paymentWebhookHandler receives the provider's notification. The body must
+// be signed with the provider's webhook secret, and the payment status is
+// then confirmed with the provider before the order is updated.
+func paymentWebhookHandler(c *gin.Context) {
+	provider, ok := paymentProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown payment provider"})
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if !verifyWebhookSignature(provider.WebhookSecret(), body, c.GetHeader("X-Signature")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature"})
+		return
+	}
+
+	var info PaymentWebhookInfo
+	if err := json.Unmarshal(body, &info); err != nil || info.Reference == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	payment, err := getPayment(provider.Name(), info.Reference)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := provider.Verify(payment.Reference)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to verify payment"})
+		return
+	}
+	if err := settlePayment(payment, result); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": result.Status})
+}
+
+type MockPaymentInfo struct {
+	Status PaymentStatus `json:"status"`
+}
+
+// completeMockPaymentHandler plays the customer and the provider for the mock
+// provider: it completes the payment and settles it as the webhook would.
+func completeMockPaymentHandler(c *gin.Context) {
+	var info MockPaymentInfo
+	if err := c.ShouldBindJSON(&info); err != nil || info.Status == "" {
+		info.Status = PaymentSucceeded
+	}
+
+	ref := c.Param("reference")
+	for _, p := range paymentProviders {
+		mock, ok := p.(*mockPaymentProvider)
+		if !ok || mock.Complete(ref, info.Status) != nil {
+			continue
+		}
+
+		payment, err := getPayment(mock.Name(), ref)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		result, err := mock.Verify(ref)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := settlePayment(payment, result); err != nil {
+			respondError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"status": result.Status})
+		return
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+}
+
+type CashCollectionRequestInfo struct {
+	Amount int `json:"amount"`
+}
+
+func collectCashHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+	var info CashCollectionRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := collectCashPayment(id, user.ID, info.Amount); err != nil {
+		respondError(c, err)
+		return
+	}
+	recordAudit(c, AuditCashCollect, user.ID, "order", strconv.Itoa(id), gin.H{"amount": info.Amount})
+	c.JSON(http.StatusOK, gin.H{"message": "Payment collected"})
+}
+
+// courierShipHandler lets the courier take a prepared order out for
+// delivery, so that cash-on-delivery orders can reach the door and be
+// collected without going through the admin
+func courierShipHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+	// Couriers only handle cash-on-delivery orders, the others are shipped
+	// from the admin
+	order, err := getOrder(id)
+	if err == sql.ErrNoRows || (err == nil && order.PaymentMethod != PaymentMethodCashOnDelivery) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if order.State != CartStatePreparing {
+		c.JSON(http.StatusConflict, gin.H{"error": "Order is not ready for delivery"})
+		return
+	}
+
+	note := fmt.Sprintf("Out for delivery with courier %d", user.ID)
+	if err := transitionCartNow(order.CartID, CartStateShipped, &user.ID, note); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Order out for delivery"})
+}
+
+type ReconciliationRequestInfo struct {
+	Date      string `form:"date"`
+	CourierID int    `form:"courierId"` // admins only
+}
+
+func courierCollectionsHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	var info ReconciliationRequestInfo
+	c.ShouldBind(&info)
+	if _, err := time.Parse("2006-01-02", info.Date); err != nil {
+		info.Date = time.Now().Format("2006-01-02")
+	}
+	if info.CourierID == 0 || !hasRole(user, RoleAdmin) {
+		info.CourierID = user.ID
+	}
+
+	r, err := getCourierReconciliation(info.CourierID, info.Date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+type ShippingQuoteRequestInfo struct {
+	AddressID int `form:"addressId"`
+	ShippingDestination
+}
+
+func shippingQuoteHandler(c *gin.Context) {
+	var info ShippingQuoteRequestInfo
+	if err := c.ShouldBindQuery(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	dest := info.ShippingDestination
+	if user, ok := currentUser(c); ok && info.AddressID != 0 {
+		address, err := getAddress(user.ID, info.AddressID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		dest = address.Destination()
+	}
+
+	cart, ok := userCart(c, false)
+	if !ok {
+		return
+	}
+	quote, err := quoteShipping(cart, dest)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, quote)
+}
+
+func shippingZonesHandler(c *gin.Context) {
+	zones, err := getShippingZones()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, zones)
+}
+
+func bindAddress(c *gin.Context) (*Address, bool) {
+	var a Address
+	if err := c.BindJSON(&a); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return nil, false
+	}
+
+	a.Quartier = strings.TrimSpace(a.Quartier)
+	a.City = strings.TrimSpace(a.City)
+	a.Telephone = strings.TrimSpace(a.Telephone)
+	if a.Country == "" {
+		a.Country = "SN"
+	}
+	if a.Quartier == "" || a.City == "" || a.Telephone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quartier, city and telephone are required"})
+		return nil, false
+	}
+	return &a, true
+}
+
+func getAddressesHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	addresses, err := getAddresses(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, addresses)
+}
+
+func createAddressHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	a, ok := bindAddress(c)
+	if !ok {
+		return
+	}
+	a.ID = 0
+	if err := saveAddress(user.ID, a); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, a)
+}
+
+func updateAddressHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address id"})
+		return
+	}
+	a, ok := bindAddress(c)
+	if !ok {
+		return
+	}
+	a.ID = id
+	err = saveAddress(user.ID, a)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+func deleteAddressHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid address id"})
+		return
+	}
+	err = deleteAddress(user.ID, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Address not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Address deleted"})
+}
+
+type AdminOrderFilter struct {
+	Page     int    `form:"page"`
+	State    string `form:"state"`
+	From     string `form:"from"`
+	To       string `form:"to"`
+	Unviewed bool   `form:"unviewed"`
+}
+
+func adminOrdersHandler(c *gin.Context) {
+	var info AdminOrderFilter
+	if err := c.ShouldBind(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filters"})
+		return
+	}
+	if info.Page <= 0 {
+		info.Page = 1
+	}
+
+	state := CartState(-1)
+	if info.State != "" {
+		s, err := parseCartState(info.State)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid state"})
+			return
+		}
+		state = s
+	}
+	for _, d := range []string{info.From, info.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dates must be formatted as YYYY-MM-DD"})
+			return
+		}
+	}
+
+	orders, s, err := getAdminOrders(info, state, (info.Page-1)*12, 12)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"orders": orders, "pages": (s / 12)+1})
+}
+
+func adminOrderHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+
+	order, err := getAdminOrder(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+type MarkViewedRequestInfo struct {
+	IDs    []int `json:"ids"`
+	Viewed *bool `json:"viewed"`
+}
+
+func markOrdersViewedHandler(c *gin.Context) {
+	var info MarkViewedRequestInfo
+	if err := c.BindJSON(&info); err != nil || len(info.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	viewed := true
+	if info.Viewed != nil {
+		viewed = *info.Viewed
+	}
+
+	if err := markOrdersViewed(info.IDs, viewed); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	admin, _ := currentUser(c)
+	recordAudit(c, AuditOrdersViewed, admin.ID, "order", "", gin.H{"ids": info.IDs, "viewed": viewed})
+	c.JSON(http.StatusOK, gin.H{"message": "Orders updated"})
+}
+
+func unviewedOrdersCountHandler(c *gin.Context) {
+	counts, total, err := getUnviewedOrderCounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "byState": counts})
+}
+
+type OrderStateRequestInfo struct {
+	State CartState `json:"state"`
+	Note  string    `json:"note"`
+}
+
+func adminOrderStateHandler(c *gin.Context) {
+	p, _ := currentPrincipal(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid order id"})
+		return
+	}
+	var info OrderStateRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	order, err := getOrder(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Changes made through an API key have no user: the history shows the
+	// key's name in the note instead
+	var actorID *int
+	if p.UserID != 0 {
+		actorID = &p.UserID
+	} else {
+		info.Note = strings.TrimSpace("[" + p.Name + "] " + info.Note)
+	}
+
+	if err := transitionCartNow(order.CartID, info.State, actorID, info.Note); err != nil {
+		respondError(c, err)
+		return
+	}
+	recordPrincipalAudit(c, p, AuditOrderState, "order", strconv.Itoa(id), gin.H{"from": order.State, "to": info.State, "note": info.Note})
+
+	updated, err := getAdminOrder(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+func hasRole(user User, roles ...string) bool {
+	for _, r := range roles {
+		if containsString(user.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole lets through users holding at least one of the given roles.
+// Roles are read from the token claims, so it must run after jwtMiddleware.
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing auth token"})
+			return
+		}
+		if !hasRole(user, roles...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+type RoleRequestInfo struct {
+	Role string `json:"role"`
+}
+
+func userRolesHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	roles, err := getUserRoles(id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"userId": id, "roles": roles})
+}
+
+func grantRoleHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+	var info RoleRequestInfo
+	if err := c.BindJSON(&info); err != nil || !containsString(grantableRoles, info.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+
+	if err := grantRole(id, info.Role); err != nil {
+		respondError(c, err)
+		return
+	}
+	admin, _ := currentUser(c)
+	recordAudit(c, AuditRoleGrant, admin.ID, "user", strconv.Itoa(id), gin.H{"role": info.Role})
+	userRolesHandler(c)
+}
+
+func revokeRoleHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+	role := c.Param("role")
+	if !containsString(grantableRoles, role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role"})
+		return
+	}
+	if id == user.ID && role == RoleAdmin {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Admins cannot revoke their own admin role"})
+		return
+	}
+
+	if err := revokeRole(id, role); err != nil {
+		respondError(c, err)
+		return
+	}
+	recordAudit(c, AuditRoleRevoke, user.ID, "user", strconv.Itoa(id), gin.H{"role": role})
+	userRolesHandler(c)
+}
+
+// currentClaims returns the token claims stored in the context by jwtMiddleware
+func currentClaims(c *gin.Context) (*Claims, bool) {
+	claimsCtx, exists := c.Get("claims")
+	if !exists {
+		return nil, false
+	}
+	claims, ok := claimsCtx.(*Claims)
+	return claims, ok
+}
+
+type RefreshRequestInfo struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+func refreshTokenHandler(c *gin.Context) {
+	var info RefreshRequestInfo
+	fromCookie := false
+	if err := c.ShouldBindJSON(&info); err != nil || info.RefreshToken == "" {
+		t, err := c.Cookie(refreshCookieName)
+		if err != nil || t == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		info.RefreshToken = t
+		fromCookie = true
+	}
+
+	refresh, err := randomHex(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	sessionID, userID, err := rotateSession(hashToken(info.RefreshToken), hashToken(refresh), refreshTokenTTL)
+	if err == errSessionRevoked {
+		recordAudit(c, AuditRefreshReuse, userID, "session", strconv.Itoa(sessionID), nil)
+	}
+	if err == sql.ErrNoRows || err == errSessionRevoked {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := newAuthToken(userID, sessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+	respondTokens(c, &AuthTokens{Token: token, RefreshToken: refresh, ExpiresIn: int(accessTokenTTL.Seconds())}, fromCookie)
+}
+
+func logoutHandler(c *gin.Context) {
+	claims, ok := currentClaims(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	if err := revokeSession(claims.SessionID, claims.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditLogout, claims.UserID, "session", strconv.Itoa(claims.SessionID), nil)
+	clearSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+func logoutAllHandler(c *gin.Context) {
+	claims, ok := currentClaims(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	n, err := revokeUserSessions(claims.UserID, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditLogoutAll, claims.UserID, "user", strconv.Itoa(claims.UserID), gin.H{"sessions": n})
+	clearSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out of all devices", "sessions": n})
+}
+
+func sessionsHandler(c *gin.Context) {
+	claims, ok := currentClaims(c)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	sessions, err := getActiveSessions(claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claims.SessionID
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+const passwordResetTTL = time.Hour
+
+type ForgotPasswordRequestInfo struct {
+	Email string `json:"email"`
+}
+
+// forgotPasswordHandler always answers the same way so that it cannot be used
+// to find out which emails have an account
+func forgotPasswordHandler(c *gin.Context) {
+	var info ForgotPasswordRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	response := gin.H{"message": "If this email has an account, a reset link has been sent"}
+
+	// Every request counts, so that nobody can flood an inbox with links
+	email := normalizeEmail(info.Email)
+	limits := map[string]LimitPolicy{
+		"reset:ip:" + c.ClientIP(): resetIPPolicy,
+		"reset:email:" + email:     resetEmailPolicy,
+	}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+
+	// The link goes to the stored address, not to what was typed
+	var userID int
+	var to string
+	err := db.QueryRow("SELECT id, email FROM users WHERE lower(email) = $1 ORDER BY email = $1 DESC, id LIMIT 1", email).Scan(&userID, &to)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println("Failed to look up user for password reset:", err)
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := randomHex(32)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+	if err := createPasswordReset(userID, hashToken(token), passwordResetTTL); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	link := frontendURL() + "/reset-password?token=" + token
+	err = mailer.Send(Mail{
+		To:      to,
+		Subject: "Réinitialisation de votre mot de passe",
+		Body: "Bonjour,\n\n" +
+			"Pour choisir un nouveau mot de passe, ouvrez le lien suivant :\n" + link + "\n\n" +
+			"Ce lien est valable une heure et ne peut être utilisé qu'une fois. " +
+			"Si vous n'êtes pas à l'origine de cette demande, ignorez ce message.\n",
+	})
+	if err != nil {
+		log.Println("Failed to send password reset email:", err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+type ResetPasswordRequestInfo struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func resetPasswordHandler(c *gin.Context) {
+	var info ResetPasswordRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(info.Password) < 8 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters long"})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(info.Password), 8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	userID, err := resetPassword(hashToken(info.Token), string(hashedPassword))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	recordAudit(c, AuditPasswordReset, 0, "user", strconv.Itoa(userID), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+}
+
+const emailVerificationTTL = 48 * time.Hour
+
+// sendVerificationEmail emails a link confirming that the user owns email
+func sendVerificationEmail(userID int, email string) error {
+	token, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+	if err := createEmailVerification(userID, email, hashToken(token), emailVerificationTTL); err != nil {
+		return err
+	}
+
+	link := frontendURL() + "/verify-email?token=" + token
+	return mailer.Send(Mail{
+		To:      email,
+		Subject: "Confirmez votre adresse email",
+		Body: "Bonjour,\n\n" +
+			"Pour confirmer votre adresse email, ouvrez le lien suivant :\n" + link + "\n\n" +
+			"Ce lien est valable 48 heures.\n",
+	})
+}
+
+type VerifyEmailRequestInfo struct {
+	Token string `json:"token" form:"token"`
+}
+
+func verifyEmailHandler(c *gin.Context) {
+	var info VerifyEmailRequestInfo
+	if err := c.ShouldBind(&info); err != nil || info.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	if err := verifyEmail(hashToken(info.Token)); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email verified"})
+}
+
+func resendVerificationHandler(c *gin.Context) {
+	user, _ := currentUser(c)
+
+	verified, err := isEmailVerified(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if verified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email is already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(user.ID, user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send verification email"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// requireVerifiedEmail blocks users who have not confirmed their email yet.
+// It must run after jwtMiddleware.
+func requireVerifiedEmail() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing auth token"})
+			return
+		}
+		verified, err := isEmailVerified(user.ID)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !verified {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Email not verified"})
+			return
+		}
+		c.Next()
+	}
+}
+
+const (
+	phoneOTPTTL         = 5 * time.Minute
+	phoneOTPResendDelay = time.Minute
+	phoneOTPMaxAttempts = 5
+
+	phoneOTPLogin  = "login"
+	phoneOTPVerify = "verify"
+)
+
+type PhoneLoginRequestInfo struct {
+	Telephone string `json:"telephone"`
+	Code      string `json:"code"`
+}
+
+// randomDigits returns a uniformly random numeric code of n digits
+func randomDigits(n int) (string, error) {
+	b := make([]byte, n)
+	for i := range b {
+		d, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		b[i] = byte('0' + d.Int64())
+	}
+	return string(b), nil
+}
+
+// requestPhoneCodeHandler texts a login code to the account that confirmed
+// the number. The answer is the same whether such an account exists or not.
+func requestPhoneCodeHandler(c *gin.Context) {
+	var info PhoneLoginRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	phone, err := normalizeSenegalPhone(info.Telephone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	response := gin.H{"message": "If this number has an account, a code has been sent"}
+
+	userID, err := getUserIDByPhone(phone)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	code, err := randomDigits(6)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create code"})
+		return
+	}
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(code), 8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash code"})
+		return
+	}
+	err = createPhoneOTP(userID, phone, phoneOTPLogin, string(codeHash), phoneOTPTTL, phoneOTPResendDelay)
+	var ie *inputError
+	if errors.As(err, &ie) {
+		// Too early for a new code; saying so would reveal the account
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := smsSender.Send(phone, "Votre code de connexion Djolof Shop : "+code+". Il expire dans 5 minutes."); err != nil {
+		log.Println("Failed to send login code:", err)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func verifyPhoneCodeHandler(c *gin.Context) {
+	var info PhoneLoginRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	phone, err := normalizeSenegalPhone(info.Telephone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := consumePhoneOTP(phone, phoneOTPLogin, info.Code, phoneOTPMaxAttempts)
+	if err != nil {
+		var ie *inputError
+		if errors.As(err, &ie) {
+			recordAudit(c, AuditLoginFailed, 0, "phone", auditHash(phone), gin.H{"via": c.FullPath()})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": ie.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	completeLogin(c, userID)
+}
+
+// profilePhone returns the user's number in E.164, or an error to show when
+// it cannot receive a code
+func profilePhone(userID int) (*User, string, error) {
+	user, err := getUserById(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if user.Telephone == "" {
+		return nil, "", &inputError{"Add a phone number to your profile first"}
+	}
+	phone, err := normalizeSenegalPhone(user.Telephone)
+	if err != nil {
+		return nil, "", &inputError{err.Error()}
+	}
+	return user, phone, nil
+}
+
+// sendPhoneVerificationHandler texts a code confirming the number of the
+// user's profile. Only confirmed numbers can log in.
+func sendPhoneVerificationHandler(c *gin.Context) {
+	current, _ := currentUser(c)
+
+	user, phone, err := profilePhone(current.ID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if user.TelephoneVerified {
+		c.JSON(http.StatusConflict, gin.H{"error": "Phone number is already verified"})
+		return
+	}
+
+	code, err := randomDigits(6)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create code"})
+		return
+	}
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(code), 8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash code"})
+		return
+	}
+	if err := createPhoneOTP(user.ID, phone, phoneOTPVerify, string(codeHash), phoneOTPTTL, phoneOTPResendDelay); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := smsSender.Send(phone, "Votre code de vérification Djolof Shop : "+code+". Il expire dans 5 minutes."); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send the code"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Verification code sent"})
+}
+
+func verifyPhoneHandler(c *gin.Context) {
+	current, _ := currentUser(c)
+
+	var info PhoneLoginRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	user, phone, err := profilePhone(current.ID)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	userID, err := consumePhoneOTP(phone, phoneOTPVerify, info.Code, phoneOTPMaxAttempts)
+	if err == nil && userID != user.ID {
+		err = &inputError{"Invalid or expired code"}
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := verifyUserPhone(user.ID, user.Telephone); err != nil {
+		respondError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Phone number verified"})
+}
+
+// tooManyAttempts counts the attempt on the keys and answers 429 when one of
+// them must still wait. Handlers call limitSucceeded when the attempt
+// succeeds, so that only failures slow the keys down.
+func tooManyAttempts(c *gin.Context, limits map[string]LimitPolicy) bool {
+	wait, locked, err := limitAttempt(limits)
+	if err != nil {
+		log.Println("Failed to check rate limit:", err)
+		return false
+	}
+	for _, key := range locked {
+		until := time.Now().Add(limits[key].Lockout)
+		recordLimitEvent(key, "lockout", c.ClientIP(), &until)
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	keys := []string{}
+	for key := range limits {
+		recordLimitEvent(key, "blocked", c.ClientIP(), nil)
+		keys = append(keys, auditLimitKey(key))
+	}
+	sort.Strings(keys)
+	actorID := 0
+	if user, ok := currentUser(c); ok {
+		actorID = user.ID
+	}
+	recordAudit(c, AuditAttemptBlocked, actorID, "limit", "", gin.H{"via": c.FullPath(), "keys": keys})
+
+	seconds := int(wait.Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later", "retryAfter": seconds})
+	return true
+}
+
+// loginFailed audits a failed login; tooManyAttempts already counted it
+func loginFailed(c *gin.Context, targetType string, targetID string) {
+	recordAudit(c, AuditLoginFailed, 0, targetType, targetID, gin.H{"via": c.FullPath()})
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+}
+
+func lockoutsHandler(c *gin.Context) {
+	events, err := getActiveLockouts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+type ClearLockoutRequestInfo struct {
+	Key string `json:"key"`
+}
+
+func clearLockoutHandler(c *gin.Context) {
+	var info ClearLockoutRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Key == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := clearLockout(info.Key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	admin, _ := currentUser(c)
+	recordAudit(c, AuditLockoutClear, admin.ID, "limit", auditLimitKey(info.Key), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Lockout cleared"})
+}
+
+const (
+	twoFactorTokenTTL  = 5 * time.Minute
+	recoveryCodesCount = 10
+)
+
+func newTwoFactorToken(userID int) (string, error) {
+	claims := &TwoFactorClaims{
+		UserID: userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "2fa",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(twoFactorTokenTTL)),
+		},
+	}
+	return keyManager.Sign(claims)
+}
+
+func parseTwoFactorToken(tokenStr string) (int, error) {
+	claims := &TwoFactorClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, keyManager.Keyfunc)
+	if err != nil || !token.Valid || claims.Subject != "2fa" || claims.UserID == 0 {
+		return 0, errors.New("Invalid or expired token")
+	}
+	return claims.UserID, nil
+}
+
+type TwoFactorLoginRequestInfo struct {
+	PartialToken string `json:"partialToken"`
+	Code         string `json:"code"`
+}
+
+// twoFactorLoginHandler upgrades a partial token to a full session with a
+// TOTP or recovery code
+func twoFactorLoginHandler(c *gin.Context) {
+	var info TwoFactorLoginRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	userID, err := parseTwoFactorToken(info.PartialToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+
+	limits := map[string]LimitPolicy{
+		"login:ip:" + c.ClientIP():         loginIPPolicy,
+		"2fa:user:" + strconv.Itoa(userID): loginAccountPolicy,
+	}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+
+	if err := checkSecondFactor(userID, info.Code, true); err != nil {
+		var ie *inputError
+		if errors.As(err, &ie) {
+			loginFailed(c, "user", strconv.Itoa(userID))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	limitSucceeded(limits)
+	if err := limiterStore.Delete("2fa:user:" + strconv.Itoa(userID)); err != nil {
+		log.Println("Failed to reset login limiter:", err)
+	}
+
+	finishLogin(c, userID)
+}
+
+// enrollTwoFactorHandler starts an enrollment: the secret is stored disabled
+// until a first code confirms the authenticator app is set up. Recovery codes
+// are only shown here.
+func enrollTwoFactorHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := newRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = hashToken(code)
+	}
+
+	if err := saveTOTPEnrollment(user.ID, secret, hashes); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":          secret,
+		"provisioningUri": totpURI(user.Email, secret),
+		"recoveryCodes":   codes,
+	})
+}
+
+type TwoFactorCodeRequestInfo struct {
+	Code string `json:"code"`
+}
+
+// confirmTwoFactorHandler enables the second factor and logs out the other
+// devices, whose sessions were opened without it
+func confirmTwoFactorHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	claims, _ := currentClaims(c)
+
+	var info TwoFactorCodeRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := checkSecondFactor(user.ID, info.Code, false); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := setTOTPEnabled(user.ID, true); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := revokeUserSessions(user.ID, claims.SessionID); err != nil {
+		log.Println("Failed to revoke sessions:", err)
+	}
+	recordAudit(c, AuditTwoFactorEnable, user.ID, "user", strconv.Itoa(user.ID), nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication enabled"})
+}
+
+func disableTwoFactorHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var info TwoFactorCodeRequestInfo
+	if err := c.BindJSON(&info); err != nil || info.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if err := checkSecondFactor(user.ID, info.Code, true); err != nil {
+		respondError(c, err)
+		return
+	}
+	if err := setTOTPEnabled(user.ID, false); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditTwoFactorDisable, user.ID, "user", strconv.Itoa(user.ID), nil)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+}
+
+func twoFactorStatusHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	enabled, err := isTOTPEnabled(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	remaining, err := countRecoveryCodes(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled, "recoveryCodesLeft": remaining})
+}
+
+// requireTwoFactor keeps staff without a second factor out of the routes it
+// guards; they can still reach /2fa to enroll. When roles are given only users
+// with one of them need the second factor.
+func requireTwoFactor(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := currentUser(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+		if len(roles) > 0 && !hasRole(user, roles...) {
+			c.Next()
+			return
+		}
+		if !checkTwoFactor(c, user.ID) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkTwoFactor aborts the request when the user has no second factor
+func checkTwoFactor(c *gin.Context, userID int) bool {
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if !enabled {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication required"})
+		return false
+	}
+	return true
+}
+
+// jwksHandler publishes the public keys that verify our tokens
+func jwksHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+	c.JSON(http.StatusOK, gin.H{"keys": keyManager.JWKS()})
+}
+
+type ProfileRequestInfo struct {
+	Prenom    string `json:"prenom"`
+	Nom       string `json:"nom"`
+	Telephone string `json:"telephone"`
+}
+
+func updateProfileHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var info ProfileRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	info.Prenom = strings.TrimSpace(info.Prenom)
+	info.Nom = strings.TrimSpace(info.Nom)
+	if info.Prenom == "" || info.Nom == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "First and last name are required"})
+		return
+	}
+	// The phone is optional, it only has to be valid when given
+	phone := strings.TrimSpace(info.Telephone)
+	if phone != "" {
+		var err error
+		if phone, err = normalizeSenegalPhone(phone); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if err := updateProfile(user.ID, info.Prenom, info.Nom, phone); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	updated, err := getUserById(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	updated.Roles = user.Roles
+	c.JSON(http.StatusOK, updated)
+}
+
+type ChangeEmailRequestInfo struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"currentPassword"`
+}
+
+// changeEmailHandler requires the current password and sends a verification
+// link to the new address. The account keeps its current email until the
+// link is opened.
+func changeEmailHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var info ChangeEmailRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	email := normalizeEmail(info.Email)
+	if !validEmail(email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return
+	}
+	if strings.EqualFold(email, user.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This is already your email address"})
+		return
+	}
+
+	limits := map[string]LimitPolicy{"password:user:" + strconv.Itoa(user.ID): loginAccountPolicy}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+	current, err := getPasswordHash(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(current), []byte(info.CurrentPassword)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	limitSucceeded(limits)
+
+	taken, err := isEmailTaken(email, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if taken {
+		c.JSON(http.StatusConflict, gin.H{"error": "This email is already used by another account"})
+		return
+	}
+
+	if err := sendVerificationEmail(user.ID, email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditEmailChange, user.ID, "user", strconv.Itoa(user.ID), gin.H{"from": auditHash(normalizeEmail(user.Email)), "to": auditHash(email)})
+	c.JSON(http.StatusAccepted, gin.H{"message": "Verification email sent to the new address"})
+}
+
+type ChangePasswordRequestInfo struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+// changePasswordHandler requires the current password and logs out every
+// other device
+func changePasswordHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+	claims, _ := currentClaims(c)
+
+	var info ChangePasswordRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(info.NewPassword) < 8 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password must be at least 8 characters long"})
+		return
+	}
+
+	limits := map[string]LimitPolicy{"password:user:" + strconv.Itoa(user.ID): loginAccountPolicy}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+
+	current, err := getPasswordHash(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(current), []byte(info.CurrentPassword)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	limitSucceeded(limits)
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(info.NewPassword), 8)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+	if err := changePassword(user.ID, string(hashedPassword), claims.SessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditPasswordChange, user.ID, "user", strconv.Itoa(user.ID), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+}
+
+type ExportRequestInfo struct {
+	Format string `form:"format"` // json or zip (default)
+}
+
+// exportAccountHandler sends the user's personal data as a download: a JSON
+// file, or a ZIP archive with the JSON and the avatar
+func exportAccountHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var info ExportRequestInfo
+	c.ShouldBind(&info)
+
+	export, err := buildAccountExport(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	name := fmt.Sprintf("djolof-shop-donnees-%d", user.ID)
+	if info.Format == "json" {
+		c.Header("Content-Disposition", `attachment; filename="`+name+`.json"`)
+		c.Data(http.StatusOK, "application/json", data)
+		return
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("donnees.json")
+	if err == nil {
+		_, err = w.Write(data)
+	}
+	if err == nil && export.Profile.AvatarURL != "" {
+		err = addAvatarToZip(zw, export.Profile.AvatarURL)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+func buildAccountExport(userID int) (*AccountExport, error) {
+	var e AccountExport
+	var err error
+
+	e.ExportedAt = time.Now().UTC().Format(time.RFC3339)
+	if e.Profile, err = getUserById(userID); err != nil {
+		return nil, err
+	}
+	if e.Profile.Roles, err = getUserRoles(userID); err != nil {
+		return nil, err
+	}
+	if e.Addresses, err = getAddresses(userID); err != nil {
+		return nil, err
+	}
+	if e.Comments, err = getUserComments(userID); err != nil {
+		return nil, err
+	}
+	if e.Carts, err = getUserCarts(userID); err != nil {
+		return nil, err
+	}
+	if e.Orders, _, err = getUserOrders(userID, 0, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	if e.Sessions, err = getActiveSessions(userID); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// avatarPath maps an avatar URL to its file in ./uploads
+func avatarPath(avatarURL string) string {
+	return filepath.Join("./uploads", filepath.Base(avatarURL))
+}
+
+func addAvatarToZip(zw *zip.Writer, avatarURL string) error {
+	f, err := os.Open(avatarPath(avatarURL))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.Create("avatar" + filepath.Ext(avatarURL))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+type DeleteAccountRequestInfo struct {
+	Password string `json:"password"`
+}
+
+// deleteAccountHandler anonymizes the account after checking the password.
+// Admins must give up their role first, and orders on their way must be
+// delivered or cancelled.
+func deleteAccountHandler(c *gin.Context) {
+	user, ok := currentUser(c)
+	if !ok {
+		return
+	}
+
+	var info DeleteAccountRequestInfo
+	if err := c.BindJSON(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	limits := map[string]LimitPolicy{"password:user:" + strconv.Itoa(user.ID): loginAccountPolicy}
+	if tooManyAttempts(c, limits) {
+		return
+	}
+
+	current, err := getPasswordHash(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(current), []byte(info.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Password is incorrect"})
+		return
+	}
+	limitSucceeded(limits)
+
+	if hasRole(user, RoleAdmin) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Admins must have their role revoked before deleting their account"})
+		return
+	}
+	inProgress, err := hasOrdersInProgress(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if inProgress {
+		c.JSON(http.StatusConflict, gin.H{"error": "The account can be deleted once your current orders are delivered or cancelled"})
+		return
+	}
+
+	avatarURL, err := anonymizeUser(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditAccountDelete, user.ID, "user", strconv.Itoa(user.ID), nil)
+	if avatarURL != "" {
+		if err := os.Remove(avatarPath(avatarURL)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove avatar:", err)
+		}
+	}
+
+	clearSessionCookies(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// recordAudit appends an entry to the audit log with the request's IP and
+// user agent. actorID is 0 for anonymous requests. Failures are only logged:
+// the audited action already happened.
+func recordAudit(c *gin.Context, action string, actorID int, targetType string, targetID string, details gin.H) {
+	writeAudit(c, action, actorID, 0, targetType, targetID, details)
+}
+
+// recordPrincipalAudit records an action of the caller of an integration
+// route, which is either a user or an API key
+func recordPrincipalAudit(c *gin.Context, p Principal, action string, targetType string, targetID string, details gin.H) {
+	writeAudit(c, action, p.UserID, p.APIKeyID, targetType, targetID, details)
+}
+
+func writeAudit(c *gin.Context, action string, actorID int, apiKeyID int, targetType string, targetID string, details gin.H) {
+	var actor, apiKey *int
+	if actorID != 0 {
+		actor = &actorID
+	}
+	if apiKeyID != 0 {
+		apiKey = &apiKeyID
+	}
+	var d interface{}
+	if details != nil {
+		d = details
+	}
+	if err := insertAuditEntry(action, actor, apiKey, targetType, targetID, c.ClientIP(), c.Request.UserAgent(), d); err != nil {
+		log.Println("Failed to record audit entry:", err)
+	}
+}
+
+// auditHashKey keys the hashes that stand for emails and phone numbers in the
+// audit log, which is never purged
+var auditHashKey []byte
+
+// auditHash identifies an email or phone number in the audit log without
+// storing it. Entries about a known value are found by hashing it again.
+func auditHash(v string) string {
+	mac := hmac.New(sha256.New, auditHashKey)
+	mac.Write([]byte(v))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditLimitKey hashes the email a limiter key ends with
+func auditLimitKey(key string) string {
+	if i := strings.LastIndex(key, ":"); i >= 0 && strings.Contains(key[i+1:], "@") {
+		return key[:i+1] + auditHash(key[i+1:])
+	}
+	return key
+}
+
+type AuditFilter struct {
+	Page       int    `form:"page"`
+	Action     string `form:"action"`
+	ActorID    int    `form:"actorId"`
+	APIKeyID   int    `form:"apiKeyId"`
+	TargetType string `form:"targetType"`
+	TargetID   string `form:"targetId"`
+	IP         string `form:"ip"`
+	From       string `form:"from"`
+	To         string `form:"to"`
+	Format     string `form:"format"` // csv exports every matching entry
+}
+
+const auditExportMax = 100000
+
+func auditLogHandler(c *gin.Context) {
+	var info AuditFilter
+	if err := c.ShouldBind(&info); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filters"})
+		return
+	}
+	if info.Page <= 0 {
+		info.Page = 1
+	}
+	for _, d := range []string{info.From, info.To} {
+		if _, err := time.Parse("2006-01-02", d); d != "" && err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Dates must be formatted as YYYY-MM-DD"})
+			return
+		}
+	}
+
+	if info.Format == "csv" {
+		entries, _, err := getAuditEntries(info, 0, auditExportMax)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		writeAuditCSV(c, entries)
+		return
+	}
+
+	entries, s, err := getAuditEntries(info, (info.Page-1)*50, 50)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "pages": (s / 50)+1})
+}
+
+// csvCell keeps spreadsheets from running a cell as a formula by prefixing
+// the characters that start one with a quote
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+func writeAuditCSV(c *gin.Context, entries []AuditEntry) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="audit-`+time.Now().Format("2006-01-02")+`.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "date", "action", "actor_id", "actor_api_key_id", "target_type", "target_id", "ip", "user_agent", "details"})
+	for _, e := range entries {
+		actor, apiKey := "", ""
+		if e.ActorID != nil {
+			actor = strconv.Itoa(*e.ActorID)
+		}
+		if e.ActorAPIKeyID != nil {
+			apiKey = strconv.Itoa(*e.ActorAPIKeyID)
+		}
+		w.Write([]string{strconv.Itoa(e.ID), e.Date, e.Action, actor, apiKey, csvCell(e.TargetType), csvCell(e.TargetID), csvCell(e.IP), csvCell(e.UserAgent), csvCell(string(e.Details))})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Println("Failed to write audit CSV:", err)
+	}
+}
+
+const (
+	apiKeyPrefix     = "djk_"
+	apiKeyHeaderName = "X-API-Key"
+)
+
+func currentPrincipal(c *gin.Context) (Principal, bool) {
+	pCtx, exists := c.Get("principal")
+	if !exists {
+		return Principal{}, false
+	}
+	p, ok := pCtx.(Principal)
+	return p, ok
+}
+
+// authMiddleware accepts either a user JWT or an API key, sent in X-API-Key
+// or as a Bearer token. Handlers read the caller with currentPrincipal.
+func authMiddleware() gin.HandlerFunc {
+	jwtAuth := jwtMiddleware()
+	return func(c *gin.Context) {
+		key := c.GetHeader(apiKeyHeaderName)
+		if key == "" {
+			if t, fromCookie := requestToken(c); !fromCookie && strings.HasPrefix(t, apiKeyPrefix) {
+				key = t
+			}
+		}
+		if key == "" {
+			jwtAuth(c)
+			return
+		}
+
+		k, err := useAPIKey(hashToken(key))
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set("principal", Principal{Kind: PrincipalAPIKey, APIKeyID: k.ID, Name: k.Name, Scopes: k.Scopes})
+		c.Next()
+	}
+}
+
+// requireScope lets through principals holding the scope. Admins using their
+// JWT must also have a second factor, as on the admin routes.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		p, ok := currentPrincipal(c)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing auth token"})
+			return
+		}
+		if !p.HasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing scope " + scope})
+			return
+		}
+		if p.Kind == PrincipalUser && !checkTwoFactor(c, p.UserID) {
+			return
+		}
+		c.Next()
+	}
+}
+
+func principalHandler(c *gin.Context) {
+	p, _ := currentPrincipal(c)
+	c.JSON(http.StatusOK, p)
+}
+
+type CreateAPIKeyRequestInfo struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays *int     `json:"expiresInDays"` // 365 when omitted, 0 never expires
+}
+
+func apiKeysHandler(c *gin.Context) {
+	keys, err := getAPIKeys()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+// createAPIKeyHandler returns the key in clear text; it cannot be shown again
+func createAPIKeyHandler(c *gin.Context) {
+	admin, _ := currentUser(c)
+
+	var info CreateAPIKeyRequestInfo
+	if err := c.BindJSON(&info); err != nil || strings.TrimSpace(info.Name) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if len(info.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one scope is required"})
+		return
+	}
+	for _, scope := range info.Scopes {
+		if !containsString(apiScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid scope " + scope})
+			return
+		}
+	}
+	days := 365
+	if info.ExpiresInDays != nil {
+		days = *info.ExpiresInDays
+	}
+	if days < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiry"})
+		return
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	k, err := createAPIKey(strings.TrimSpace(info.Name), key[:len(apiKeyPrefix)+8], hashToken(key), info.Scopes, admin.ID, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditAPIKeyCreate, admin.ID, "api_key", strconv.Itoa(k.ID), gin.H{"name": k.Name, "scopes": k.Scopes})
+
+	c.JSON(http.StatusCreated, gin.H{"apiKey": k, "key": key})
+}
+
+func revokeAPIKeyHandler(c *gin.Context) {
+	admin, _ := currentUser(c)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key id"})
+		return
+	}
+
+	err = revokeAPIKey(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordAudit(c, AuditAPIKeyRevoke, admin.ID, "api_key", strconv.Itoa(id), nil)
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
+
+type ProductStockRequestInfo struct {
+	Quantity *int `json:"quantity"`
+	Price    *int `json:"price"`
+}
+
+// updateProductStockHandler is used by the inventory sync
+func updateProductStockHandler(c *gin.Context) {
+	p, _ := currentPrincipal(c)
+
+	var info ProductStockRequestInfo
+	if err := c.BindJSON(&info); err != nil || (info.Quantity == nil && info.Price == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if (info.Quantity != nil && *info.Quantity < 0) || (info.Price != nil && *info.Price < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity and price cannot be negative"})
+		return
+	}
+
+	sku := c.Param("sku")
+	quantity, price, err := updateProductStock(sku, info.Quantity, info.Price)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordPrincipalAudit(c, p, AuditProductUpdate, "product", sku, gin.H{"quantity": info.Quantity, "price": info.Price})
+
+	c.JSON(http.StatusOK, gin.H{"sku": sku, "quantity": quantity, "price": price})
+}
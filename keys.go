@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// jwtKeyRetention is how long a retired key still verifies tokens. It must
+// outlive the longest token we sign, the guest cart token.
+const jwtKeyRetention = cartTokenTTL + 24*time.Hour
+
+// jwksMaxAge is how long clients may cache the JWKS
+const jwksMaxAge = 5 * time.Minute
+
+// jwtKeyReloadEvery is how often every instance rotates and reloads its keys
+const jwtKeyReloadEvery = time.Hour
+
+// jwtKeyPublishLead is how long a new key is published before it signs: every
+// instance must have reloaded it and the cached JWKS of clients must have
+// expired.
+const jwtKeyPublishLead = jwtKeyReloadEvery + jwksMaxAge
+
+// sealedKeyPrefix marks private keys encrypted with JWT_KEY_ENCRYPTION_KEY,
+// rows written before the encryption hold a plain PEM
+const sealedKeyPrefix = "v1:"
+
+// signingKey is one of the keys known to the KeyManager, identified by the
+// kid header of the tokens it signed
+type signingKey struct {
+	id     string
+	method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// KeyManager signs and verifies every JWT of the server.
+//
+// With HS256 (the default) the key is JWT_SECRET; secrets listed in
+// JWT_PREVIOUS_SECRETS are still accepted for verification. With RS256 or
+// EdDSA the keys live in the jwt_keys table so that every instance shares
+// them: a new key is generated every JWT_ROTATE_EVERY and the old ones keep
+// verifying for jwtKeyRetention. Their public halves are served as a JWKS.
+// The private keys are encrypted with JWT_KEY_ENCRYPTION_KEY, 32 bytes in
+// base64. JWT_SECRET may still verify the tokens issued before the switch
+// until JWT_SECRET_EXPIRES, an RFC 3339 date.
+type KeyManager struct {
+	mu          sync.RWMutex
+	alg         string
+	every       time.Duration
+	keys        map[string]*signingKey
+	current     string
+	legacy      string    // key for tokens without kid, issued before the manager
+	legacyUntil time.Time // zero when the legacy key signs
+	sealer      cipher.AEAD
+	lastReload  time.Time
+}
+
+var keyManager *KeyManager
+
+func newKeyManagerFromEnv() (*KeyManager, error) {
+	alg := strings.TrimSpace(os.Getenv("JWT_ALG"))
+	if alg == "" {
+		alg = "HS256"
+	}
+	km := &KeyManager{alg: alg, keys: map[string]*signingKey{}}
+
+	secret := os.Getenv("JWT_SECRET")
+	if secret != "" {
+		km.legacy = km.addHMAC(secret)
+	}
+
+	switch alg {
+	case "HS256":
+		if secret == "" {
+			return nil, errors.New("JWT_SECRET is required to sign tokens with HS256")
+		}
+		if len(secret) < 32 {
+			log.Println("Warning: JWT_SECRET is shorter than 32 bytes")
+		}
+		km.current = km.legacy
+		for _, s := range strings.Split(os.Getenv("JWT_PREVIOUS_SECRETS"), ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				km.addHMAC(s)
+			}
+		}
+
+	case "RS256", "EdDSA":
+		if secret != "" {
+			v := os.Getenv("JWT_SECRET_EXPIRES")
+			until, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid JWT_SECRET_EXPIRES %q: set the date after which JWT_SECRET tokens are refused, or unset JWT_SECRET", v)
+			}
+			km.legacyUntil = until
+		}
+
+		encKey, err := base64.StdEncoding.DecodeString(os.Getenv("JWT_KEY_ENCRYPTION_KEY"))
+		if err != nil || len(encKey) != 32 {
+			return nil, errors.New("JWT_KEY_ENCRYPTION_KEY must hold 32 bytes in base64")
+		}
+		block, err := aes.NewCipher(encKey)
+		if err != nil {
+			return nil, err
+		}
+		if km.sealer, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+
+		km.every = 30 * 24 * time.Hour
+		if v := os.Getenv("JWT_ROTATE_EVERY"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid JWT_ROTATE_EVERY: %q", v)
+			}
+			km.every = d
+		}
+		if err := km.rotate(); err != nil {
+			return nil, err
+		}
+		if err := km.reload(); err != nil {
+			return nil, err
+		}
+		if km.current == "" {
+			return nil, errors.New("no signing key available")
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALG %q, use HS256, RS256 or EdDSA", alg)
+	}
+
+	return km, nil
+}
+
+func (km *KeyManager) addHMAC(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	id := "hs-" + hex.EncodeToString(sum[:4])
+	km.keys[id] = &signingKey{id: id, method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+	return id
+}
+
+// Sign signs the claims with the current key and sets the kid header
+func (km *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	km.mu.RLock()
+	key := km.keys[km.current]
+	km.mu.RUnlock()
+
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.sign)
+}
+
+// Keyfunc picks the verification key of a token for jwt.Parse. The token's
+// alg must match the key's, so a public key cannot be used as an HMAC secret.
+func (km *KeyManager) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key := km.lookup(kid)
+	if key == nil && kid != "" && km.alg != "HS256" {
+		// Another instance may just have rotated
+		if err := km.reloadIfStale(); err != nil {
+			log.Println("Failed to reload JWT keys:", err)
+		}
+		key = km.lookup(kid)
+	}
+	if key == nil {
+		return nil, errors.New("Unknown signing key")
+	}
+	if key.id == km.legacy && !km.legacyUntil.IsZero() && time.Now().After(km.legacyUntil) {
+		return nil, errors.New("Expired signing key")
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("Unexpected signing method")
+	}
+	return key.verify, nil
+}
+
+func (km *KeyManager) lookup(kid string) *signingKey {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	if kid == "" {
+		kid = km.legacy
+	}
+	return km.keys[kid]
+}
+
+// reload reads the asymmetric keys from the database. HMAC keys come from the
+// environment and are kept as they are.
+func (km *KeyManager) reload() error {
+	stored, err := getJWTKeys(km.alg)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]*signingKey{}
+	current := ""
+	for _, sk := range stored {
+		privatePEM, err := km.open(sk.ID, sk.PrivateKey)
+		if err != nil {
+			log.Printf("Skipping JWT key %s: %v", sk.ID, err)
+			continue
+		}
+		key, err := parseSigningKey(sk.ID, km.alg, privatePEM)
+		if err != nil {
+			log.Printf("Skipping JWT key %s: %v", sk.ID, err)
+			continue
+		}
+		if !strings.HasPrefix(sk.PrivateKey, sealedKeyPrefix) {
+			sealed, err := km.seal(sk.ID, privatePEM)
+			if err == nil {
+				err = updateJWTPrivateKey(sk.ID, sealed)
+			}
+			if err != nil {
+				log.Printf("Failed to encrypt JWT key %s: %v", sk.ID, err)
+			}
+		}
+		keys[key.id] = key
+		if sk.Active {
+			current = key.id
+		}
+	}
+
+	km.mu.Lock()
+	defer km.mu.Unlock()
+	for id, key := range km.keys {
+		if key.method == jwt.SigningMethodHS256 {
+			keys[id] = key
+		}
+	}
+	km.keys = keys
+	if current != "" {
+		km.current = current
+	}
+	km.lastReload = time.Now()
+	return nil
+}
+
+func (km *KeyManager) reloadIfStale() error {
+	km.mu.RLock()
+	stale := time.Since(km.lastReload) > 10*time.Second
+	km.mu.RUnlock()
+	if !stale {
+		return nil
+	}
+	return km.reload()
+}
+
+// rotate creates a new key when the current one is older than the rotation
+// period, or when there is none yet
+func (km *KeyManager) rotate() error {
+	rotated, err := rotateJWTKey(km.alg, km.every, jwtKeyPublishLead, jwtKeyRetention, func() (string, string, error) {
+		kid, privatePEM, err := generateSigningKey(km.alg)
+		if err != nil {
+			return "", "", err
+		}
+		sealed, err := km.seal(kid, privatePEM)
+		return kid, sealed, err
+	})
+	if err != nil {
+		return err
+	}
+	if rotated {
+		log.Println("Rotated JWT signing key")
+	}
+	return nil
+}
+
+// StartRotation checks hourly whether the key is due for rotation and picks
+// up the keys rotated by other instances
+func (km *KeyManager) StartRotation() {
+	if km.alg == "HS256" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(jwtKeyReloadEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := km.rotate(); err != nil {
+				log.Println("Failed to rotate JWT key:", err)
+			}
+			if err := km.reload(); err != nil {
+				log.Println("Failed to reload JWT keys:", err)
+			}
+		}
+	}()
+}
+
+// JWKS lists the public keys, newest first. HMAC secrets are never published.
+func (km *KeyManager) JWKS() []JWK {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+
+	jwks := []JWK{}
+	for _, key := range km.keys {
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch pub := key.verify.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		if key.id == km.current {
+			jwks = append([]JWK{jwk}, jwks...)
+		} else {
+			jwks = append(jwks, jwk)
+		}
+	}
+	return jwks
+}
+
+// seal encrypts a PEM private key for the jwt_keys table. The kid is
+// authenticated with it so that rows cannot be swapped.
+func (km *KeyManager) seal(kid string, privatePEM string) (string, error) {
+	nonce := make([]byte, km.sealer.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := km.sealer.Seal(nonce, nonce, []byte(privatePEM), []byte(kid))
+	return sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open decrypts a private key sealed by seal; a plain PEM is returned as is
+func (km *KeyManager) open(kid string, stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedKeyPrefix) {
+		return stored, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedKeyPrefix))
+	if err != nil {
+		return "", err
+	}
+	n := km.sealer.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("sealed key too short")
+	}
+	plain, err := km.sealer.Open(nil, sealed[:n], sealed[n:], []byte(kid))
+	if err != nil {
+		return "", errors.New("cannot decrypt, check JWT_KEY_ENCRYPTION_KEY")
+	}
+	return string(plain), nil
+}
+
+// generateSigningKey returns a new kid and its PKCS#8 PEM private key
+func generateSigningKey(alg string) (string, string, error) {
+	var priv interface{}
+	var err error
+	switch alg {
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", "", fmt.Errorf("unsupported alg %q", alg)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+	kid, err := randomHex(8)
+	if err != nil {
+		return "", "", err
+	}
+	return kid, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+func parseSigningKey(kid string, alg string, privatePEM string) (*signingKey, error) {
+	block, _ := pem.Decode([]byte(privatePEM))
+	if block == nil {
+		return nil, errors.New("invalid PEM")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		if alg != "RS256" {
+			break
+		}
+		return &signingKey{id: kid, method: jwt.SigningMethodRS256, sign: k, verify: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		if alg != "EdDSA" {
+			break
+		}
+		return &signingKey{id: kid, method: jwt.SigningMethodEdDSA, sign: k, verify: k.Public()}, nil
+	}
+	return nil, fmt.Errorf("key does not match %s", alg)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends transactional emails (password reset, verification...)
+type Mailer interface {
+	Send(m Mail) error
+}
+
+var mailer Mailer
+
+// newMailerFromEnv uses SMTP when SMTP_HOST is set, and writes the emails to
+// MAIL_DIR (./mail by default) otherwise
+func newMailerFromEnv() Mailer {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		return &fileMailer{dir: dir}
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	return &smtpMailer{
+		addr:     host + ":" + port,
+		host:     host,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+		from:     os.Getenv("MAIL_FROM"),
+	}
+}
+
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (s *smtpMailer) Send(m Mail) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+	if err := smtp.SendMail(s.addr, auth, s.from, []string{m.To}, formatMail(s.from, m)); err != nil {
+		return fmt.Errorf("send mail failed: %v", err)
+	}
+	return nil
+}
+
+// fileMailer writes every email to its own file, for local development
+type fileMailer struct {
+	dir string
+}
+
+func (f *fileMailer) Send(m Mail) error {
+	if err := os.MkdirAll(f.dir, os.ModePerm); err != nil {
+		return fmt.Errorf("create mail dir failed: %v", err)
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(m.To, "/", "_"))
+	if err := os.WriteFile(filepath.Join(f.dir, name), formatMail("noreply@localhost", m), 0o644); err != nil {
+		return fmt.Errorf("write mail failed: %v", err)
+	}
+	return nil
+}
+
+func formatMail(from string, m Mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", m.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", m.Subject)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(m.Body)
+	return []byte(b.String())
+}
+
+// frontendURL is where the links sent by email point to
+func frontendURL() string {
+	if u := os.Getenv("FRONTEND_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return "http://localhost:5173"
+}
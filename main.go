@@ -33,8 +33,51 @@ func main() {
 	initDB()
 	defer db.Close()
 
+	keyManager, err = newKeyManagerFromEnv()
+	if err != nil {
+		log.Fatal("Failed to load JWT keys: ", err)
+	}
+	keyManager.StartRotation()
+
+	auditHashKey = []byte(os.Getenv("AUDIT_HASH_KEY"))
+	if len(auditHashKey) == 0 {
+		log.Fatal("AUDIT_HASH_KEY is required to hash emails and phone numbers in the audit log")
+	}
+
+	mailer = newMailerFromEnv()
+	cookieConfig = newCookieConfigFromEnv()
+	if os.Getenv("LIMITER_STORE") == "postgres" {
+		limiterStore = &pgLimiterStore{db: db}
+	}
+
+	// Only the in-process mock exists for now; PAYMENT_MOCK must be set to
+	// enable it so that orders cannot be marked paid for free in production.
+	mockPayments := os.Getenv("PAYMENT_MOCK") == "true"
+	if mockPayments {
+		secret := []byte(os.Getenv("PAYMENT_WEBHOOK_SECRET"))
+		if len(secret) == 0 {
+			secret = []byte("mock-webhook-secret")
+		}
+		registerPaymentProvider(newMockPaymentProvider("wave", secret))
+		registerPaymentProvider(newMockPaymentProvider("orange_money", secret))
+	}
+
 	router := gin.Default()
 
+	// ClientIP keys the rate limiter, sessions and the audit log, so
+	// X-Forwarded-For is only trusted when it comes from one of the proxies
+	// listed in TRUSTED_PROXIES (comma separated IPs or CIDRs). Without it
+	// the remote address of the connection is used.
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES: ", err)
+	}
+
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{
 			"http://localhost:3000",
@@ -42,8 +85,8 @@ func main() {
 			"https://djolof-shop.vercel.app",
 		},
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization", "X-Cart-Token", "X-CSRF-Token", "X-API-Key"},
+		ExposeHeaders:    []string{"Content-Length", "X-Cart-Token"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -52,23 +95,118 @@ func main() {
 	router.Static("/uploads", "./uploads")
 	router.Static("/public", "./public")
 
+	router.GET("/.well-known/jwks.json", jwksHandler)
+
 	api := router.Group("/api")
 	{
 		api.POST("/signup", signupHandler)
 		api.POST("/login", loginHandler)
+		api.POST("/login/phone", requestPhoneCodeHandler)
+		api.POST("/login/phone/verify", verifyPhoneCodeHandler)
+		api.POST("/login/2fa", twoFactorLoginHandler)
+		api.POST("/token/refresh", refreshTokenHandler)
+		api.POST("/password/forgot", forgotPasswordHandler)
+		api.POST("/password/reset", resetPasswordHandler)
+		api.POST("/email/verify", verifyEmailHandler)
 		api.GET("/blog", blogHandler)
 		api.GET("/article/:id", getBlogPost)
 		api.GET("/article/side", getBlogPostSide)
 		api.GET("/blog/categories", getCategoriesHandle)
 		api.GET("/blog/tags", getTagsHandle)
 		api.GET("/blog/search", articleSearchHandler)
+		api.GET("/products", productsHandler)
+		api.GET("/product/:sku", getProductDetail)
+		api.POST("/payments/webhook/:provider", paymentWebhookHandler)
+		if mockPayments {
+			api.POST("/payments/mock/:reference", completeMockPaymentHandler)
+		}
+
+		// Cart routes work for guests (cart token) and logged-in users
+		cart := api.Group("/cart")
+		cart.Use(optionalJWTMiddleware())
+		{
+			cart.GET("", getCartHandler)
+			cart.DELETE("", clearCartHandler)
+			cart.POST("/items", addCartItemHandler)
+			cart.PUT("/items", updateCartItemHandler)
+			cart.DELETE("/items", removeCartItemHandler)
+		}
+
+		api.GET("/shipping/zones", shippingZonesHandler)
+		api.GET("/shipping/quote", optionalJWTMiddleware(), shippingQuoteHandler)
 
 		// Protected routes group
 		protected := api.Group("/")
 		protected.Use(jwtMiddleware()) // Apply JWT middleware
 		{
 			protected.GET("/dashboard", dashboardHandler)
+			protected.POST("/logout", logoutHandler)
+			protected.POST("/logout/all", logoutAllHandler)
+			protected.GET("/sessions", sessionsHandler)
 			protected.POST("/upload-avatar", uploadAvatarHandler)
+			protected.PUT("/profile", updateProfileHandler)
+			protected.POST("/profile/email", changeEmailHandler)
+			protected.POST("/profile/password", changePasswordHandler)
+			protected.GET("/account/export", exportAccountHandler)
+			protected.DELETE("/account", deleteAccountHandler)
+			protected.POST("/email/verify/resend", resendVerificationHandler)
+			protected.POST("/phone/verify/send", sendPhoneVerificationHandler)
+			protected.POST("/phone/verify", verifyPhoneHandler)
+			protected.POST("/checkout", requireVerifiedEmail(), checkoutHandler)
+			protected.GET("/orders", ordersHandler)
+			protected.GET("/orders/:id", orderHandler)
+			protected.POST("/orders/:id/pay", requireVerifiedEmail(), payOrderHandler)
+
+			protected.GET("/2fa", twoFactorStatusHandler)
+			protected.POST("/2fa/enroll", requireRole(staffRoles...), enrollTwoFactorHandler)
+			protected.POST("/2fa/confirm", requireRole(staffRoles...), confirmTwoFactorHandler)
+			protected.POST("/2fa/disable", disableTwoFactorHandler)
+
+			protected.GET("/addresses", getAddressesHandler)
+			protected.POST("/addresses", createAddressHandler)
+			protected.PUT("/addresses/:id", updateAddressHandler)
+			protected.DELETE("/addresses/:id", deleteAddressHandler)
+		}
+
+		admin := api.Group("/admin")
+		admin.Use(jwtMiddleware(), requireRole(RoleAdmin), requireTwoFactor())
+		{
+			admin.GET("/audit", auditLogHandler)
+			admin.GET("/api-keys", apiKeysHandler)
+			admin.POST("/api-keys", createAPIKeyHandler)
+			admin.DELETE("/api-keys/:id", revokeAPIKeyHandler)
+			admin.GET("/lockouts", lockoutsHandler)
+			admin.POST("/lockouts/clear", clearLockoutHandler)
+			admin.GET("/users/:id/roles", userRolesHandler)
+			admin.POST("/users/:id/roles", grantRoleHandler)
+			admin.DELETE("/users/:id/roles/:role", revokeRoleHandler)
+
+			admin.GET("/orders", adminOrdersHandler)
+			admin.GET("/orders/unviewed-count", unviewedOrdersCountHandler)
+			admin.POST("/orders/viewed", markOrdersViewedHandler)
+			admin.GET("/orders/:id", adminOrderHandler)
+			admin.POST("/orders/:id/state", adminOrderStateHandler)
+		}
+
+		// Server-to-server routes (inventory sync, delivery partner), open to
+		// API keys and admins by scope
+		integration := api.Group("/integration")
+		integration.Use(authMiddleware())
+		{
+			integration.GET("/me", principalHandler)
+			integration.GET("/products", requireScope(ScopeProductsRead), productsHandler)
+			integration.PUT("/products/:sku/stock", requireScope(ScopeProductsWrite), updateProductStockHandler)
+			integration.GET("/orders", requireScope(ScopeOrdersRead), adminOrdersHandler)
+			integration.GET("/orders/:id", requireScope(ScopeOrdersRead), adminOrderHandler)
+			integration.POST("/orders/:id/state", requireScope(ScopeOrdersWrite), adminOrderStateHandler)
+		}
+
+		courier := api.Group("/courier")
+		courier.Use(jwtMiddleware(), requireRole(RoleCourier, RoleAdmin), requireTwoFactor(RoleAdmin))
+		{
+			courier.POST("/orders/:id/ship", courierShipHandler)
+			courier.POST("/orders/:id/collect", collectCashHandler)
+			courier.GET("/collections", courierCollectionsHandler)
 		}
 	}
 
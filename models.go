@@ -1,18 +1,128 @@
 package main
 
-import "github.com/golang-jwt/jwt/v4"
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v4"
+)
 
 // Credentials struct for login/signup
 type Credentials struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
+
+// SignupRequestInfo is the signup form
+type SignupRequestInfo struct {
+	Prenom    string `json:"prenom"`
+	Nom       string `json:"nom"`
+	Telephone string `json:"telephone"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
 // Claims struct for JWT
 type Claims struct {
+	UserID    int      `json:"userId"`
+	Roles     []string `json:"roles"`
+	SessionID int      `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// JWK is a public signing key as published in /.well-known/jwks.json
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// Session is a logged-in device, kept alive by its refresh token
+type Session struct {
+	ID         int    `json:"id"`
+	UserAgent  string `json:"userAgent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"createdAt"`
+	LastUsedAt string `json:"lastUsedAt"`
+	Current    bool   `json:"current"`
+}
+
+const (
+	RoleCustomer = "customer"
+	RoleAuthor   = "author"
+	RoleEditor   = "editor"
+	RoleAdmin    = "admin"
+	RoleCourier  = "courier"
+)
+
+// grantableRoles are the roles an admin can grant; customer is implied
+var grantableRoles = []string{RoleAuthor, RoleEditor, RoleAdmin, RoleCourier}
+
+// staffRoles can edit the shop or the blog and may use a second factor
+var staffRoles = []string{RoleAuthor, RoleEditor, RoleAdmin}
+
+// API key scopes
+const (
+	ScopeProductsRead  = "products:read"
+	ScopeProductsWrite = "products:write"
+	ScopeOrdersRead    = "orders:read"
+	ScopeOrdersWrite   = "orders:write"
+)
+
+var apiScopes = []string{ScopeProductsRead, ScopeProductsWrite, ScopeOrdersRead, ScopeOrdersWrite}
+
+const (
+	PrincipalUser   = "user"
+	PrincipalAPIKey = "api_key"
+)
+
+// Principal is whoever makes a request: a logged-in user or an API key.
+// Admins hold every scope.
+type Principal struct {
+	Kind     string   `json:"kind"`
+	UserID   int      `json:"userId,omitempty"`
+	APIKeyID int      `json:"apiKeyId,omitempty"`
+	Name     string   `json:"name"`
+	Roles    []string `json:"roles,omitempty"`
+	Scopes   []string `json:"scopes"`
+}
+
+func (p Principal) HasScope(scope string) bool {
+	return containsString(p.Scopes, scope)
+}
+
+// APIKey gives a server-to-server integration access to the scoped routes.
+// Only a hash of the key is stored; Prefix identifies it in the admin.
+type APIKey struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedBy  *int     `json:"createdBy"`
+	CreatedAt  string   `json:"createdAt"`
+	ExpiresAt  *string  `json:"expiresAt"`
+	LastUsedAt *string  `json:"lastUsedAt"`
+	RevokedAt  *string  `json:"revokedAt"`
+}
+
+// TwoFactorClaims is the partial token of a login waiting for its second
+// factor. It only grants access to the /login/2fa endpoint.
+type TwoFactorClaims struct {
 	UserID int `json:"userId"`
 	jwt.RegisteredClaims
 }
 
+// CartClaims identifies a guest cart in the signed cart token
+type CartClaims struct {
+	CartID int `json:"cartId"`
+	jwt.RegisteredClaims
+}
+
 // ---------- Users & Authors ----------
 type Author struct {
 	ID        int    `json:"id"`
@@ -22,17 +132,39 @@ type Author struct {
 }
 
 type User struct {
-	ID        int     `json:"id"`
-	Prenom    string `json:"prenom"`
-	Nom       string `json:"nom"`
-	Telephone string `json:"telephone"`
-	Email     string  `json:"email"`
-	Password  string  `json:"-"`        // never expose in JSON
-	AvatarURL string `json:"avatarUrl"`
-	AuthorID  int    `json:"authorId"`
-	DoesLogin bool    `json:"doesLogin"`
+	ID                int      `json:"id"`
+	Prenom            string   `json:"prenom"`
+	Nom               string   `json:"nom"`
+	Telephone         string   `json:"telephone"`
+	Email             string   `json:"email"`
+	Password          string   `json:"-"`        // never expose in JSON
+	AvatarURL         string   `json:"avatarUrl"`
+	AuthorID          int      `json:"authorId"`
+	DoesLogin         bool     `json:"doesLogin"`
+	Roles             []string `json:"roles"`
+	EmailVerified     bool     `json:"emailVerified"`
+	TelephoneVerified bool     `json:"telephoneVerified"` // confirmed by SMS, required for phone login
+}
+
+
+// AccountExport is the personal data archive of a user
+type AccountExport struct {
+	ExportedAt string            `json:"exportedAt"`
+	Profile    *User             `json:"profile"`
+	Addresses  []Address         `json:"addresses"`
+	Comments   []ExportedComment `json:"comments"`
+	Carts      []Cart            `json:"carts"`
+	Orders     []Order           `json:"orders"`
+	Sessions   []Session         `json:"sessions"`
 }
 
+type ExportedComment struct {
+	ID           int    `json:"id"`
+	ArticleID    int    `json:"articleId"`
+	ArticleTitle string `json:"articleTitle"`
+	Date         string `json:"date"`
+	Comment      string `json:"comment"`
+}
 
 // ---------- Articles ----------
 type Markup struct {
@@ -100,13 +232,288 @@ type ProductCategory struct {
 // ---------- Carts ----------
 type Cart struct {
 	ID        int               `json:"id"`
-	UserID    int               `json:"userId"`
-	Content   map[string]int    `json:"content"` // product_sku -> quantity
+	UserID    *int              `json:"userId"` // nil for guest carts
+	Content   []CartItem        `json:"content"` // one line per sku/color/size
 	CreatedAt string            `json:"createdAt"`
-	State     int               `json:"state"`
+	State     CartState         `json:"state"`
 	Viewed    bool              `json:"viewed"`
 }
 
+type CartItem struct {
+	SKU      string `json:"sku" form:"sku"`
+	Color    string `json:"color" form:"color"`
+	Size     string `json:"size" form:"size"`
+	Quantity int    `json:"quantity" form:"quantity"`
+}
+
+// CartState is the lifecycle of a cart, from an open basket to a delivered
+// (or cancelled) order. It is stored as an integer in carts.state.
+type CartState int
+
+const (
+	CartStateOpen CartState = iota
+	CartStateCheckedOut
+	CartStatePaid
+	CartStatePreparing
+	CartStateShipped
+	CartStateDelivered
+	CartStateCancelled
+	CartStateRefunded
+)
+
+var cartStateNames = map[CartState]string{
+	CartStateOpen:       "open",
+	CartStateCheckedOut: "checked_out",
+	CartStatePaid:       "paid",
+	CartStatePreparing:  "preparing",
+	CartStateShipped:    "shipped",
+	CartStateDelivered:  "delivered",
+	CartStateCancelled:  "cancelled",
+	CartStateRefunded:   "refunded",
+}
+
+// cartTransitions lists the states each state may legally move to
+var cartTransitions = map[CartState][]CartState{
+	CartStateOpen:       {CartStateCheckedOut},
+	CartStateCheckedOut: {CartStatePaid, CartStateCancelled},
+	CartStatePaid:       {CartStatePreparing, CartStateRefunded},
+	CartStatePreparing:  {CartStateShipped, CartStateRefunded},
+	CartStateShipped:    {CartStateDelivered},
+	CartStateDelivered:  {CartStateRefunded},
+}
+
+// codCartTransitions replaces cartTransitions for cash-on-delivery orders,
+// which are prepared and shipped before the cash is collected at the door
+var codCartTransitions = map[CartState][]CartState{
+	CartStateOpen:       {CartStateCheckedOut},
+	CartStateCheckedOut: {CartStatePreparing, CartStateCancelled},
+	CartStatePreparing:  {CartStateShipped, CartStateCancelled},
+	CartStateShipped:    {CartStatePaid, CartStateCancelled},
+	CartStatePaid:       {CartStateDelivered},
+	CartStateDelivered:  {CartStateRefunded},
+}
+
+const (
+	PaymentMethodMobileMoney    = "mobile_money"
+	PaymentMethodCashOnDelivery = "cash_on_delivery"
+)
+
+func (s CartState) String() string {
+	if name, ok := cartStateNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("CartState(%d)", int(s))
+}
+
+func (s CartState) CanTransitionTo(to CartState, paymentMethod string) bool {
+	transitions := cartTransitions
+	if paymentMethod == PaymentMethodCashOnDelivery {
+		transitions = codCartTransitions
+	}
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCartState(name string) (CartState, error) {
+	for s, n := range cartStateNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown state %q", name)
+}
+
+func (s CartState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *CartState) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	parsed, err := parseCartState(name)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// StateChange is one row of the cart state history
+type StateChange struct {
+	From    CartState `json:"from"`
+	To      CartState `json:"to"`
+	ActorID *int      `json:"actorId"` // nil when done by the system
+	Note    string    `json:"note"`
+	Date    string    `json:"date"`
+}
+
+// ---------- Orders ----------
+type Order struct {
+	ID              int           `json:"id"`
+	UserID          int           `json:"userId"`
+	CartID          int           `json:"cartId"`
+	Total           int           `json:"total"` // includes the shipping fee
+	ShippingFee     int           `json:"shippingFee"`
+	ShippingZone    string        `json:"shippingZone"`
+	ShippingAddress *Address      `json:"shippingAddress"` // snapshot taken at checkout
+	Currency        string        `json:"currency"`
+	PaymentMethod   string        `json:"paymentMethod"`
+	CreatedAt       string        `json:"createdAt"`
+	State           CartState     `json:"state"`
+	Lines           []OrderLine   `json:"lines"`
+	History         []StateChange `json:"history"`
+}
+
+// AdminOrder is the order as seen in the admin inbox
+type AdminOrder struct {
+	Order
+	Viewed   bool `json:"viewed"`
+	Customer User `json:"customer"`
+}
+
+type Payment struct {
+	ID        int           `json:"id"`
+	OrderID   int           `json:"orderId"`
+	Provider  string        `json:"provider"`
+	Reference string        `json:"reference"`
+	Amount    int           `json:"amount"`
+	Status    PaymentStatus `json:"status"`
+	CreatedAt string        `json:"createdAt"`
+}
+
+// CashCollection is the cash a courier collected for a cash-on-delivery order
+type CashCollection struct {
+	OrderID     int    `json:"orderId"`
+	CourierID   int    `json:"courierId"`
+	Amount      int    `json:"amount"`
+	CollectedAt string `json:"collectedAt"`
+}
+
+type CourierReconciliation struct {
+	CourierID   int              `json:"courierId"`
+	Date        string           `json:"date"`
+	Total       int              `json:"total"`
+	Collections []CashCollection `json:"collections"`
+}
+
+// OrderLine is a snapshot of the product as it was sold
+type OrderLine struct {
+	SKU       string `json:"sku"`
+	Name      string `json:"name"`
+	Color     string `json:"color"`
+	Size      string `json:"size"`
+	UnitPrice int    `json:"unitPrice"`
+	Quantity  int    `json:"quantity"`
+	LineTotal int    `json:"lineTotal"`
+}
+
+
+// ---------- Addresses ----------
+type Address struct {
+	ID        int    `json:"id"`
+	Label     string `json:"label"` // e.g. "Maison", "Bureau"
+	Recipient string `json:"recipient"`
+	Telephone string `json:"telephone"`
+	Quartier  string `json:"quartier"`
+	City      string `json:"city"`
+	Country   string `json:"country"`
+	Landmark  string `json:"landmark"` // directions for the courier
+	IsDefault bool   `json:"isDefault"`
+}
+
+func (a Address) Destination() ShippingDestination {
+	return ShippingDestination{Quartier: a.Quartier, City: a.City, Country: a.Country}
+}
+
+// ---------- Shipping ----------
+type ShippingZone struct {
+	ID            int      `json:"id"`
+	Name          string   `json:"name"`
+	Localities    []string `json:"localities"` // lower case city or quartier names
+	International bool     `json:"international"`
+	BaseFee       int      `json:"baseFee"`
+	PerItemFee    int      `json:"perItemFee"`
+	PerKgFee      int      `json:"perKgFee"`
+	FreeThreshold *int     `json:"freeThreshold"` // subtotal from which delivery is free
+}
+
+// Fee computes the delivery fee of an order of the given subtotal, item count
+// and weight in grams. Every started kilogram is charged.
+func (z ShippingZone) Fee(subtotal int, items int, grams int) int {
+	if z.FreeThreshold != nil && subtotal >= *z.FreeThreshold {
+		return 0
+	}
+	kgs := (grams + 999) / 1000
+	return z.BaseFee + z.PerItemFee*items + z.PerKgFee*kgs
+}
+
+type ShippingDestination struct {
+	Quartier string `json:"quartier" form:"quartier"`
+	City     string `json:"city" form:"city"`
+	Country  string `json:"country" form:"country"`
+}
+
+type ShippingQuote struct {
+	Zone     ShippingZone `json:"zone"`
+	Subtotal int          `json:"subtotal"`
+	Fee      int          `json:"fee"`
+	Total    int          `json:"total"`
+	Currency string       `json:"currency"`
+}
+
+// LimitEvent is a recorded rate limiting event: a blocked attempt or a lockout
+type LimitEvent struct {
+	Key         string  `json:"key"`
+	Event       string  `json:"event"`
+	IP          string  `json:"ip"`
+	LockedUntil *string `json:"lockedUntil"`
+	Date        string  `json:"date"`
+}
+
+// Audited actions
+const (
+	AuditLogin            = "login"
+	AuditLoginFailed      = "login_failed"
+	AuditAttemptBlocked   = "attempt_blocked"
+	AuditLogout           = "logout"
+	AuditLogoutAll        = "logout_all"
+	AuditRefreshReuse     = "refresh_token_reuse"
+	AuditPasswordChange   = "password_change"
+	AuditPasswordReset    = "password_reset"
+	AuditEmailChange      = "email_change_requested"
+	AuditTwoFactorEnable  = "2fa_enable"
+	AuditTwoFactorDisable = "2fa_disable"
+	AuditRoleGrant        = "role_grant"
+	AuditRoleRevoke       = "role_revoke"
+	AuditOrderState       = "order_state"
+	AuditOrdersViewed     = "orders_viewed"
+	AuditLockoutClear     = "lockout_clear"
+	AuditAccountDelete    = "account_delete"
+	AuditCashCollect      = "cash_collect"
+	AuditAPIKeyCreate     = "api_key_create"
+	AuditAPIKeyRevoke     = "api_key_revoke"
+	AuditProductUpdate    = "product_update"
+)
+
+// AuditEntry is a row of the append-only audit log
+type AuditEntry struct {
+	ID            int             `json:"id"`
+	Date          string          `json:"date"`
+	Action        string          `json:"action"`
+	ActorID       *int            `json:"actorId"`       // nil when anonymous
+	ActorAPIKeyID *int            `json:"actorApiKeyId"` // set for actions taken with an API key
+	TargetType    string          `json:"targetType"`
+	TargetID      string          `json:"targetId"`
+	IP            string          `json:"ip"`
+	UserAgent     string          `json:"userAgent"`
+	Details       json.RawMessage `json:"details"`
+}
 
 // ------ Utilities
 
@@ -134,6 +541,27 @@ type BlogPostSide struct {
 	Recents    []Article         `json:"recents"`
 }
 
+type ProductDetail struct {
+	Product    Product           `json:"product"`
+	Collection *Collection       `json:"collection"`
+	Categories []ProductCategory `json:"categories"`
+	Sims       []Product         `json:"sims"`
+}
+
+type CartLine struct {
+	CartItem
+	Name      string `json:"name"`
+	UnitPrice int    `json:"unitPrice"`
+	LineTotal int    `json:"lineTotal"`
+}
+
+type CartView struct {
+	Cart     Cart       `json:"cart"`
+	Lines    []CartLine `json:"lines"`
+	Total    int        `json:"total"`
+	Currency string     `json:"currency"`
+}
+
 type CategoriesTags struct {
 	Categories []ArticleCategory `json:"categories"`
 	Tags       []Tag             `json:"tags"`
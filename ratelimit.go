@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// LimitPolicy describes how repeated failures on a key are slowed down.
+// After FreeAttempts failures every new attempt must wait BaseDelay, doubled
+// for each further failure up to MaxDelay. LockoutAfter failures lock the key
+// for Lockout. Failures older than Window are forgotten.
+type LimitPolicy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int // 0 never locks
+	Lockout      time.Duration
+	Window       time.Duration
+}
+
+var (
+	loginIPPolicy = LimitPolicy{
+		FreeAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Minute,
+		LockoutAfter: 100, Lockout: time.Hour, Window: time.Hour,
+	}
+	loginAccountPolicy = LimitPolicy{
+		FreeAttempts: 3, BaseDelay: 2 * time.Second, MaxDelay: 5 * time.Minute,
+		LockoutAfter: 10, Lockout: 30 * time.Minute, Window: time.Hour,
+	}
+	signupIPPolicy = LimitPolicy{
+		FreeAttempts: 5, BaseDelay: 10 * time.Second, MaxDelay: 10 * time.Minute,
+		Window: time.Hour,
+	}
+	resetIPPolicy = LimitPolicy{
+		FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: time.Hour,
+		Window: time.Hour,
+	}
+	resetEmailPolicy = LimitPolicy{
+		FreeAttempts: 2, BaseDelay: 5 * time.Minute, MaxDelay: 6 * time.Hour,
+		Window: 24 * time.Hour,
+	}
+)
+
+type LimitState struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// LimiterStore keeps the limiter state. The memory store suits a single
+// instance; use the Postgres store when several instances share the load.
+// Fail must record the failure atomically, so that concurrent failures on the
+// same key are all counted, and return the state the key had before it.
+// Forgive takes back one failure.
+type LimiterStore interface {
+	Fail(key string, p LimitPolicy, now time.Time) (prev LimitState, locked bool, err error)
+	Forgive(key string) error
+	Delete(key string) error
+}
+
+var limiterStore LimiterStore = newMemoryLimiterStore()
+
+// RetryAfter is how long the key must wait before its next attempt
+func (p LimitPolicy) RetryAfter(st LimitState, now time.Time) time.Duration {
+	if now.Before(st.LockedUntil) {
+		return st.LockedUntil.Sub(now)
+	}
+	if st.Failures < p.FreeAttempts || now.Sub(st.LastFailure) > p.Window {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < st.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if next := st.LastFailure.Add(delay); now.Before(next) {
+		return next.Sub(now)
+	}
+	return 0
+}
+
+// RecordFailure returns the new state after a failure and whether it locked
+// the key
+func (p LimitPolicy) RecordFailure(st LimitState, now time.Time) (LimitState, bool) {
+	if now.Sub(st.LastFailure) > p.Window {
+		st.Failures = 0
+	}
+	st.Failures++
+	st.LastFailure = now
+
+	if p.LockoutAfter > 0 && st.Failures >= p.LockoutAfter {
+		st.Failures = 0
+		st.LockedUntil = now.Add(p.Lockout)
+		return st, true
+	}
+	return st, false
+}
+
+// limiterPruneEvery is how often the memory store drops expired keys
+const limiterPruneEvery = time.Minute
+
+type memoryLimitEntry struct {
+	LimitState
+	expires time.Time // the state no longer matters after this
+}
+
+type memoryLimiterStore struct {
+	mu        sync.Mutex
+	states    map[string]memoryLimitEntry
+	lastPrune time.Time
+}
+
+func newMemoryLimiterStore() *memoryLimiterStore {
+	return &memoryLimiterStore{states: map[string]memoryLimitEntry{}}
+}
+
+func (m *memoryLimiterStore) Fail(key string, p LimitPolicy, now time.Time) (LimitState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.states[key].LimitState
+	st, locked := p.RecordFailure(prev, now)
+	expires := st.LastFailure.Add(p.Window)
+	if st.LockedUntil.After(expires) {
+		expires = st.LockedUntil
+	}
+	m.states[key] = memoryLimitEntry{LimitState: st, expires: expires}
+
+	if now.Sub(m.lastPrune) > limiterPruneEvery {
+		for k, e := range m.states {
+			if now.After(e.expires) {
+				delete(m.states, k)
+			}
+		}
+		m.lastPrune = now
+	}
+	return prev, locked, nil
+}
+
+func (m *memoryLimiterStore) Forgive(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.states[key]; ok && e.Failures > 0 {
+		e.Failures--
+		m.states[key] = e
+	}
+	return nil
+}
+
+func (m *memoryLimiterStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.states, key)
+	return nil
+}
+
+// pgLimiterStore keeps the state in the login_limits table
+type pgLimiterStore struct {
+	db *sql.DB
+}
+
+// Fail counts the failure in a single upsert so that concurrent requests
+// cannot overwrite each other's count; previous_failure keeps the time of the
+// failure before it. The key is then locked if the returned count reached the
+// policy limit. The lock only applies while the count is still the one we
+// saw, so that a single request reports the lockout.
+func (p *pgLimiterStore) Fail(key string, policy LimitPolicy, now time.Time) (LimitState, bool, error) {
+	var prev LimitState
+	var failures int
+	var previousFailure, lockedUntil sql.NullTime
+	err := p.db.QueryRow(`
+		insert into login_limits as l (key, failures, last_failure)
+		values ($1, 1, $2)
+		on conflict (key) do update
+		set failures = case
+				when $2 - l.last_failure > $3::float8 * interval '1 second' then 1
+				else l.failures + 1
+			end,
+			previous_failure = l.last_failure,
+			last_failure = $2
+		returning failures, previous_failure, locked_until
+		`, key, now, policy.Window.Seconds()).Scan(&failures, &previousFailure, &lockedUntil)
+	if err != nil {
+		return prev, false, fmt.Errorf("upsert failed: %v", err)
+	}
+	prev = LimitState{Failures: failures - 1, LastFailure: previousFailure.Time, LockedUntil: lockedUntil.Time}
+
+	if policy.LockoutAfter <= 0 || failures < policy.LockoutAfter {
+		return prev, false, nil
+	}
+	res, err := p.db.Exec(`
+		update login_limits
+		set failures = 0, locked_until = $3
+		where key = $1 and failures = $2
+		`, key, failures, now.Add(policy.Lockout))
+	if err != nil {
+		return prev, false, fmt.Errorf("update failed: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return prev, false, fmt.Errorf("update failed: %v", err)
+	}
+	return prev, n == 1, nil
+}
+
+func (p *pgLimiterStore) Forgive(key string) error {
+	_, err := p.db.Exec("update login_limits set failures = greatest(failures - 1, 0) where key = $1", key)
+	if err != nil {
+		return fmt.Errorf("update failed: %v", err)
+	}
+	return nil
+}
+
+func (p *pgLimiterStore) Delete(key string) error {
+	if _, err := p.db.Exec("delete from login_limits where key = $1", key); err != nil {
+		return fmt.Errorf("delete failed: %v", err)
+	}
+	return nil
+}
+
+// limitAttempt counts an attempt on every key before it is made, so that
+// concurrent attempts cannot all pass the check before any is counted. It
+// returns the longest wait the keys imposed before this attempt, and the keys
+// the attempt locked. A successful attempt is taken back with limitSucceeded.
+func limitAttempt(keys map[string]LimitPolicy) (time.Duration, []string, error) {
+	now := time.Now()
+	var wait time.Duration
+	var locked []string
+	for key, p := range keys {
+		prev, lock, err := limiterStore.Fail(key, p, now)
+		if err != nil {
+			return 0, nil, err
+		}
+		if w := p.RetryAfter(prev, now); w > wait {
+			wait = w
+		}
+		if lock {
+			locked = append(locked, key)
+		}
+	}
+	return wait, locked, nil
+}
+
+// limitSucceeded takes back the attempt counted by limitAttempt
+func limitSucceeded(keys map[string]LimitPolicy) {
+	for key := range keys {
+		if err := limiterStore.Forgive(key); err != nil {
+			log.Println("Failed to update rate limit:", err)
+		}
+	}
+}
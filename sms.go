@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+)
+
+// SMSSender delivers text messages (login codes...)
+type SMSSender interface {
+	Send(to string, message string) error
+}
+
+var smsSender SMSSender = logSMSSender{}
+
+// logSMSSender writes messages to the server log instead of sending them
+type logSMSSender struct{}
+
+func (logSMSSender) Send(to string, message string) error {
+	log.Printf("SMS to %s: %s", to, message)
+	return nil
+}
+
+var errInvalidPhone = errors.New("Invalid Senegalese phone number")
+
+// normalizeSenegalPhone returns a Senegalese mobile number in E.164 form
+// (+221XXXXXXXXX). Spaces, dots and dashes are ignored and the 221 / 00221
+// prefixes are optional. Mobile numbers have 9 digits starting with 7.
+func normalizeSenegalPhone(raw string) (string, error) {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(raw) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+		case r == ' ' || r == '.' || r == '-':
+		default:
+			return "", errInvalidPhone
+		}
+	}
+
+	d := digits.String()
+	d = strings.TrimPrefix(d, "00")
+	if len(d) == 12 && strings.HasPrefix(d, "221") {
+		d = d[3:]
+	}
+	if len(d) != 9 || d[0] != '7' {
+		return "", errInvalidPhone
+	}
+	switch d[1] {
+	case '0', '5', '6', '7', '8':
+	default:
+		return "", errInvalidPhone
+	}
+	return "+221" + d, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"unicode"
+)
+
+// FieldErrors maps a JSON field name to a message shown under the form field.
+// Messages are in French, like the storefront.
+type FieldErrors map[string]string
+
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return false
+	}
+	at := strings.LastIndex(email, "@")
+	return at > 0 && strings.Contains(email[at+1:], ".")
+}
+
+// normalizeEmail is the form emails are stored and looked up in. Accounts
+// created before it may hold mixed case, so lookups still compare lower().
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// passwordProblem returns why a password is too weak, or "" if it is fine
+func passwordProblem(password string, email string) string {
+	if len(password) < 8 {
+		return "Le mot de passe doit contenir au moins 8 caractères"
+	}
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return "Le mot de passe doit contenir au moins une lettre et un chiffre"
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		return "Le mot de passe ne doit pas être votre adresse email"
+	}
+	return ""
+}
+
+// validateSignup trims and normalizes the request in place and returns the
+// errors of each invalid field
+func validateSignup(user *SignupRequestInfo) FieldErrors {
+	errs := FieldErrors{}
+
+	user.Prenom = strings.TrimSpace(user.Prenom)
+	user.Nom = strings.TrimSpace(user.Nom)
+	user.Email = normalizeEmail(user.Email)
+
+	if user.Prenom == "" {
+		errs["prenom"] = "Le prénom est obligatoire"
+	}
+	if user.Nom == "" {
+		errs["nom"] = "Le nom est obligatoire"
+	}
+
+	if user.Email == "" {
+		errs["email"] = "L'adresse email est obligatoire"
+	} else if !validEmail(user.Email) {
+		errs["email"] = "Adresse email invalide"
+	}
+
+	if msg := passwordProblem(user.Password, user.Email); msg != "" {
+		errs["password"] = msg
+	}
+
+	if strings.TrimSpace(user.Telephone) == "" {
+		errs["telephone"] = "Le numéro de téléphone est obligatoire"
+	} else if phone, err := normalizeSenegalPhone(user.Telephone); err != nil {
+		errs["telephone"] = "Numéro de téléphone sénégalais invalide (ex. 77 123 45 67)"
+	} else {
+		user.Telephone = phone
+	}
+
+	return errs
+}